@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// peersFile 节点退出时保存地址簿的文件
+const peersFile = "peers_%s.dat"
+
+// addrBucketCount 地址簿分成多少个桶. 地址按它自己和告诉我们这个地址的节点所在的网段放进桶里,
+// 选择主动连接时先随机选桶再在桶里随机选地址, 一个节点发来再多的地址也只能占满少数几个桶
+const addrBucketCount = 64
+
+// addrBucketsPerSource 同一个网段的节点告诉我们的地址最多分布在多少个桶里
+const addrBucketsPerSource = 4
+
+// addrBucketSize 每个桶最多保存的地址数量, 满了之后替换掉最差的地址
+const addrBucketSize = 32
+
+// addrHorizon 超过这个时间没有听到的地址被认为已经失效
+const addrHorizon = 30 * 24 * time.Hour
+
+// addrMaxFailures 从来没有连接成功过的地址, 连续失败这么多次之后丢弃
+const addrMaxFailures = 3
+
+// addrMaxRetries 连接成功过的地址, 连续失败这么多次之后丢弃
+const addrMaxRetries = 10
+
+// addrRetryInterval 连接失败的地址至少等这么久才会再次尝试
+const addrRetryInterval = time.Minute
+
+// addrRelayMaxAge 只转发这个时间之内听到的地址, 旧的地址只在回复getaddr时发送
+const addrRelayMaxAge = 10 * time.Minute
+
+// addrRelayMaxCount 一条addr消息里面的地址超过这个数量时, 是对getaddr的回复, 不转发
+const addrRelayMaxCount = 10
+
+// addrRelayPeers 每个新的地址转发给多少个节点
+const addrRelayPeers = 2
+
+// maxAddrPerMessage 一条addr消息最多可以有多少个地址
+const maxAddrPerMessage = 1000
+
+// maxGetAddrReply 回复getaddr时最多发送多少个地址
+const maxGetAddrReply = 100
+
+// NetAddress addr消息里面的一个地址
+type NetAddress struct {
+	Addr string
+	// Timestamp 发送方最后一次听到这个地址的时间
+	Timestamp int64
+	Services  uint64
+}
+
+// KnownAddress 地址簿里面的一个地址, 以及连接它的历史
+type KnownAddress struct {
+	Addr     string
+	Services uint64
+	// Source 告诉我们这个地址的节点所在的网段, 用于分桶
+	Source      string
+	LastSeen    time.Time
+	LastTried   time.Time
+	LastSuccess time.Time
+	// Attempts 上一次连接成功之后失败的次数
+	Attempts  int
+	Successes int
+}
+
+// isTerrible 地址已经太久没有听到, 或者连接失败太多次, 不值得再尝试
+func (ka *KnownAddress) isTerrible(now time.Time) bool {
+	if now.Sub(ka.LastSeen) > addrHorizon {
+		return true
+	}
+	if ka.Successes == 0 && ka.Attempts >= addrMaxFailures {
+		return true
+	}
+
+	return ka.Attempts >= addrMaxRetries
+}
+
+// AddrManager 地址簿, 保存听说过的节点地址, 选择主动连接的节点. 所有方法都是并发安全的
+type AddrManager struct {
+	mutex   sync.Mutex
+	addrs   map[string]*KnownAddress
+	buckets [addrBucketCount]map[string]bool
+	rand    *rand.Rand
+	// key 每个节点随机生成的分桶密钥, 和地址簿一起保存. 别人不知道它, 就算不出哪些地址会落进同一个桶
+	key []byte
+}
+
+// addrFile 地址簿文件的格式
+type addrFile struct {
+	Key   []byte
+	Addrs []KnownAddress
+}
+
+var addrManager = NewAddrManager()
+
+// NewAddrManager 创建一个空的地址簿
+func NewAddrManager() *AddrManager {
+	key := make([]byte, 32)
+	_, err := crand.Read(key)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	am := &AddrManager{addrs: make(map[string]*KnownAddress), rand: rand.New(rand.NewSource(time.Now().UnixNano())), key: key}
+	for i := range am.buckets {
+		am.buckets[i] = make(map[string]bool)
+	}
+
+	return am
+}
+
+// addrGroup 地址所在的网段: IPv4是前16位, IPv6是前32位, 主机名就是它自己.
+// 攻击者很容易在同一个网段里面拿到大量地址, 但是很难拿到很多不同的网段
+func addrGroup(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(16, 32)).String()
+	}
+
+	return ip.Mask(net.CIDRMask(32, 128)).String()
+}
+
+// addrBucket 地址放在哪个桶里. 来源的网段决定了addrBucketsPerSource个候选的桶, 地址的网段决定用其中的哪一个
+// 两次hash都混入节点自己的key, 否则攻击者可以事先算好地址, 把它们集中放进同一个桶
+func addrBucket(key []byte, addr, source string) int {
+	groupHash := sha256.Sum256(append(append([]byte{}, key...), addrGroup(addr)...))
+	slot := binary.LittleEndian.Uint64(groupHash[:8]) % addrBucketsPerSource
+
+	hash := sha256.Sum256(append(append([]byte{}, key...), fmt.Sprintf("%s/%d", source, slot)...))
+	return int(binary.LittleEndian.Uint64(hash[:8]) % addrBucketCount)
+}
+
+// validAddr 地址必须是 主机:端口 的格式
+func validAddr(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+
+	return err == nil && host != "" && port != ""
+}
+
+// Add 加入from告诉我们的地址, 已经有的地址更新最后听到的时间. 返回以前不知道的地址
+func (am *AddrManager) Add(addrs []NetAddress, from string) []NetAddress {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	now := time.Now()
+	source := addrGroup(from)
+	var added []NetAddress
+
+	for _, na := range addrs {
+		if !validAddr(na.Addr) || na.Addr == nodeAddress {
+			continue
+		}
+
+		// 对方给的时间不能超过现在, 防止一个地址永远不过期
+		seen := time.Unix(na.Timestamp, 0)
+		if seen.After(now) {
+			seen = now
+		}
+
+		if ka, ok := am.addrs[na.Addr]; ok {
+			if seen.After(ka.LastSeen) {
+				ka.LastSeen = seen
+			}
+			ka.Services |= na.Services
+			continue
+		}
+
+		ka := &KnownAddress{Addr: na.Addr, Services: na.Services, Source: source, LastSeen: seen}
+		if !am.insert(ka, now) {
+			continue
+		}
+		added = append(added, na)
+	}
+
+	return added
+}
+
+// insert 把新的地址放进它的桶里, 桶满时替换掉最差的地址. 新地址比桶里所有的都差时返回false. 调用者必须持有锁
+func (am *AddrManager) insert(ka *KnownAddress, now time.Time) bool {
+	bucket := am.buckets[addrBucket(am.key, ka.Addr, ka.Source)]
+
+	if len(bucket) >= addrBucketSize {
+		// 最差的是已经失效的地址, 其次是最久没有听到的地址
+		var worst *KnownAddress
+		for addr := range bucket {
+			candidate := am.addrs[addr]
+			if worst == nil || (candidate.isTerrible(now) && !worst.isTerrible(now)) ||
+				(candidate.isTerrible(now) == worst.isTerrible(now) && candidate.LastSeen.Before(worst.LastSeen)) {
+				worst = candidate
+			}
+		}
+		if !worst.isTerrible(now) && !worst.LastSeen.Before(ka.LastSeen) {
+			return false
+		}
+		am.remove(worst.Addr)
+	}
+
+	am.addrs[ka.Addr] = ka
+	bucket[ka.Addr] = true
+
+	return true
+}
+
+// remove 调用者必须持有锁
+func (am *AddrManager) remove(addr string) {
+	ka, ok := am.addrs[addr]
+	if !ok {
+		return
+	}
+
+	delete(am.buckets[addrBucket(am.key, ka.Addr, ka.Source)], addr)
+	delete(am.addrs, addr)
+}
+
+// Attempt 记录一次连接尝试, 连接成功时随后会调用Good. 失败太多次的地址被丢弃
+func (am *AddrManager) Attempt(addr string) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	ka, ok := am.addrs[addr]
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	ka.LastTried = now
+	ka.Attempts++
+	if ka.isTerrible(now) {
+		log.Printf("Drop address %s after %d failed attempts\n", addr, ka.Attempts)
+		am.remove(addr)
+	}
+}
+
+// Good 和addr完成了握手, 这是一个可以连接的节点
+func (am *AddrManager) Good(addr string, services uint64) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	now := time.Now()
+	ka, ok := am.addrs[addr]
+	if !ok {
+		ka = &KnownAddress{Addr: addr, Source: addrGroup(addr), LastSeen: now}
+		if !validAddr(addr) || !am.insert(ka, now) {
+			return
+		}
+	}
+
+	ka.Services = services
+	ka.LastSeen = now
+	ka.LastSuccess = now
+	ka.Attempts = 0
+	ka.Successes++
+}
+
+// Select 选择一个主动连接的地址, skip返回true的地址(例如已经连接的)不会被选中. 没有可以选的地址时返回空
+// 先随机选一个桶, 再在桶里随机选一个地址, 失败过的地址被选中的机会更小
+func (am *AddrManager) Select(skip func(addr string) bool) string {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	now := time.Now()
+	var candidates []*KnownAddress
+	for _, ka := range am.addrs {
+		// 刚刚连接失败的地址等一会儿再试
+		recentlyFailed := now.Sub(ka.LastTried) < addrRetryInterval && ka.LastTried.After(ka.LastSuccess)
+		if !recentlyFailed && !ka.isTerrible(now) && !skip(ka.Addr) {
+			candidates = append(candidates, ka)
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+
+	byBucket := make(map[int][]*KnownAddress)
+	var buckets []int
+	for _, ka := range candidates {
+		bucket := addrBucket(am.key, ka.Addr, ka.Source)
+		if len(byBucket[bucket]) == 0 {
+			buckets = append(buckets, bucket)
+		}
+		byBucket[bucket] = append(byBucket[bucket], ka)
+	}
+
+	for {
+		inBucket := byBucket[buckets[am.rand.Intn(len(buckets))]]
+		ka := inBucket[am.rand.Intn(len(inBucket))]
+		// 每失败一次, 被选中的机会减半
+		if am.rand.Float64() < 1/float64(int(1)<<uint(ka.Attempts)) {
+			return ka.Addr
+		}
+	}
+}
+
+// Sample 随机返回最多n个还有效的地址, 用于回复getaddr
+func (am *AddrManager) Sample(n int) []NetAddress {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	now := time.Now()
+	var sample []NetAddress
+	for _, ka := range am.addrs {
+		if !ka.isTerrible(now) {
+			sample = append(sample, NetAddress{ka.Addr, ka.LastSeen.Unix(), ka.Services})
+		}
+	}
+
+	am.rand.Shuffle(len(sample), func(i, j int) {
+		sample[i], sample[j] = sample[j], sample[i]
+	})
+	if len(sample) > n {
+		sample = sample[:n]
+	}
+
+	return sample
+}
+
+// Count 地址簿里面的地址数量
+func (am *AddrManager) Count() int {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	return len(am.addrs)
+}
+
+// SaveToFile 把地址簿和分桶的key保存到数据目录, 先写临时文件再改名
+func (am *AddrManager) SaveToFile(nodeID string) {
+	am.mutex.Lock()
+	data := addrFile{Key: am.key}
+	for _, ka := range am.addrs {
+		data.Addrs = append(data.Addrs, *ka)
+	}
+	am.mutex.Unlock()
+
+	var content bytes.Buffer
+	err := gob.NewEncoder(&content).Encode(data)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	file := dataFile(peersFile, nodeID)
+	err = ioutil.WriteFile(file+".new", content.Bytes(), 0644)
+	if err != nil {
+		log.Panic(err)
+	}
+	err = os.Rename(file+".new", file)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// LoadFromFile 从数据目录恢复地址簿和分桶的key, 已经失效的地址被丢弃. 返回恢复的地址数量
+func (am *AddrManager) LoadFromFile(nodeID string) int {
+	file := dataFile(peersFile, nodeID)
+	fileContent, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var data addrFile
+	err = gob.NewDecoder(bytes.NewReader(fileContent)).Decode(&data)
+	if err != nil {
+		// 旧格式的文件只有地址, 没有key, 继续使用新生成的key
+		err = gob.NewDecoder(bytes.NewReader(fileContent)).Decode(&data.Addrs)
+	}
+	if err != nil {
+		log.Printf("Ignore corrupted %s: %s\n", file, err)
+		return 0
+	}
+
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	// 已经有地址的时候它们是按现在的key分桶的, 不能再换key
+	if len(data.Key) > 0 && len(am.addrs) == 0 {
+		am.key = data.Key
+	}
+
+	now := time.Now()
+	for i := range data.Addrs {
+		ka := data.Addrs[i]
+		if _, ok := am.addrs[ka.Addr]; ok || ka.isTerrible(now) || !validAddr(ka.Addr) {
+			continue
+		}
+		am.insert(&ka, now)
+	}
+
+	return len(am.addrs)
+}
@@ -44,20 +44,25 @@ func DeserializeBlock(d []byte) *Block {
 	return &block
 }
 
-func NewBlock(transactions []*Transaction, prevBlockHash []byte, height int) *Block {
-	block := &Block{time.Now().Unix(), transactions, prevBlockHash, []byte{}, 0, height, nil}
-	pow := NewProofOfWork(block)
-	nonce, hash := pow.Run()
-
-	block.Hash = hash[:]
-	block.Nonce = nonce
+func NewBlock(transactions []*Transaction, prevBlockHash []byte, height int, timestamp int64) *Block {
+	block := &Block{timestamp, transactions, prevBlockHash, []byte{}, 0, height, nil}
+	block.Mine()
 
 	return block
 }
 
+// Mine 计算工作量证明, 填好区块的Nonce和Hash
+func (b *Block) Mine() {
+	pow := NewProofOfWork(b)
+	nonce, hash := pow.Run()
+
+	b.Hash = hash[:]
+	b.Nonce = nonce
+}
+
 func NewGenesisBlock(coinbase *Transaction) *Block {
 	// 第一个块的高度是0
-	return NewBlock([]*Transaction{coinbase}, []byte{}, 0)
+	return NewBlock([]*Transaction{coinbase}, []byte{}, 0, time.Now().Unix())
 }
 
 func (b *Block) HashTransactions() []byte {
@@ -68,7 +73,8 @@ func (b *Block) HashTransactions() []byte {
 	var transactions [][]byte
 
 	for _, tx := range b.Transactions {
-		transactions = append(transactions, tx.Serialize())
+		// Merkle根要包括签名, 否则改动区块里面的签名不会改变区块hash
+		transactions = append(transactions, tx.hashData(true))
 	}
 
 	mTree := NewMerkleTree(transactions)
@@ -8,11 +8,12 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sort"
 
 	"github.com/boltdb/bolt"
 )
 
-const dbFile = "db/blockchain_%s.db"
+const dbFile = "blockchain_%s.db"
 const blocksBucket = "blocksBucket"
 const genesisCoinbaseData = "The Times 03/Jan/2009 Chancellor on brink of second bailout for banks"
 
@@ -30,7 +31,7 @@ type Blockchain struct {
 
 // CreateBlockchain creates a new blockchain DB
 func CreateBlockchain(address string, nodeID string) *Blockchain {
-	dbFile := fmt.Sprintf(dbFile, nodeID)
+	dbFile := dataFile(dbFile, nodeID)
 	if dbExists(dbFile) {
 		fmt.Println("Blockchain already exists.")
 		os.Exit(1)
@@ -75,7 +76,7 @@ func CreateBlockchain(address string, nodeID string) *Blockchain {
 }
 
 func NewBlockchain(nodeID string) *Blockchain {
-	dbFile := fmt.Sprintf(dbFile, nodeID)
+	dbFile := dataFile(dbFile, nodeID)
 	if dbExists(dbFile) == false {
 		fmt.Println("No existing blockchain found. Create one first.")
 		os.Exit(1)
@@ -89,7 +90,8 @@ func NewBlockchain(nodeID string) *Blockchain {
 
 	err = db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		tip = b.Get([]byte("l"))
+		// bolt返回的数据只在事务里面有效, 所以要拷贝出来
+		tip = append([]byte{}, b.Get([]byte("l"))...)
 
 		return nil
 	})
@@ -99,6 +101,7 @@ func NewBlockchain(nodeID string) *Blockchain {
 	}
 
 	bc := Blockchain{tip, db}
+	UTXOSet{&bc}.ReindexIfOutdated()
 
 	return &bc
 }
@@ -169,19 +172,36 @@ func (bc *Blockchain) GetBlockHashes() [][]byte {
 }
 
 // MineBlock mines a new block with the provided transactions
-func (bc *Blockchain) MineBlock(transactions []*Transaction) *Block {
+func (bc *Blockchain) MineBlock(transactions []*Transaction) (*Block, error) {
+	newBlock, err := bc.PrepareBlock(transactions)
+	if err != nil {
+		return nil, err
+	}
+
+	newBlock.Mine()
+	bc.AddBlock(newBlock)
+
+	return newBlock, nil
+}
+
+// PrepareBlock 在最高区块后面用transactions组成一个还没有工作量证明的区块
+// 交易可以花费同一个区块里面排在它前面的交易的输出, 所以整个区块一起按照checkBlockTransactions的规则检查
+func (bc *Blockchain) PrepareBlock(transactions []*Transaction) (*Block, error) {
 	var lastHash []byte
 	var lastHeight int
 
+	size := blockReserveSize
 	for _, tx := range transactions {
-		if bc.VerifyTransaction(tx) != true {
-			log.Panic("ERROR: Invalid transaction")
-		}
+		size += len(tx.Serialize())
+	}
+
+	if size > activeNetParams.MaxBlockSize {
+		return nil, errors.New("Block is too large")
 	}
 
 	err := bc.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		lastHash = b.Get([]byte("l"))
+		lastHash = append([]byte{}, b.Get([]byte("l"))...)
 
 		blockData := b.Get(lastHash)
 		block := DeserializeBlock(blockData)
@@ -195,25 +215,22 @@ func (bc *Blockchain) MineBlock(transactions []*Transaction) *Block {
 		log.Panic(err)
 	}
 
-	newBlock := NewBlock(transactions, lastHash, lastHeight+1)
-
-	err = bc.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		err := b.Put(newBlock.Hash, newBlock.Serialize())
-		if err != nil {
-			log.Panic(err)
-		}
-
-		err = b.Put([]byte("l"), newBlock.Hash)
-		if err != nil {
-			log.Panic(err)
-		}
+	// 输入、金额、签名和时间锁都要在挖矿之前检查, 挖出来的区块才能被其他节点接受
+	template := &Block{0, transactions, lastHash, []byte{}, 0, lastHeight + 1, nil}
+	err = bc.checkBlockTransactions(template, false)
+	if err != nil {
+		return nil, err
+	}
+	medianTime := bc.CalcPastMedianTime(lastHash)
 
-		bc.tip = newBlock.Hash
+	// 区块时间必须比前面几个区块时间的中位数大
+	timestamp := timeSource.AdjustedTime()
+	if timestamp < medianTime+1 {
+		timestamp = medianTime + 1
+	}
+	template.Timestamp = timestamp
 
-		return nil
-	})
-	return newBlock
+	return template, nil
 }
 
 // AddBlock saves the block into the blockchain
@@ -256,6 +273,25 @@ func (bc *Blockchain) AddBlock(block *Block) {
 	}
 }
 
+// CalcPastMedianTime 返回以blockHash结尾(包括它自己)的前medianTimeBlocks个区块时间的中位数
+func (bc *Blockchain) CalcPastMedianTime(blockHash []byte) int64 {
+	var timestamps []int64
+	bci := &BlockchainIterator{blockHash, bc.db}
+
+	for len(timestamps) < medianTimeBlocks {
+		block := bci.Next()
+		timestamps = append(timestamps, block.Timestamp)
+
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	return timestamps[len(timestamps)/2]
+}
+
 // BlockchainIterator 区块迭代器
 type BlockchainIterator struct {
 	currentHash []byte
@@ -289,9 +325,14 @@ func (i *BlockchainIterator) Next() *Block {
 
 // FindUTXO 查询所有未花费的输出
 func (bc *Blockchain) FindUTXO() map[string]TXOutputs {
+	return bc.FindUTXOAt(bc.tip)
+}
+
+// FindUTXOAt 查询以blockHash结尾的那条链上所有未花费的输出, blockHash可以不是链的最高区块
+func (bc *Blockchain) FindUTXOAt(blockHash []byte) map[string]TXOutputs {
 	UTXO := make(map[string]TXOutputs)
 	spentTXOs := make(map[string][]int)
-	bci := bc.Iterator()
+	bci := &BlockchainIterator{blockHash, bc.db}
 
 	for {
 		block := bci.Next()
@@ -301,6 +342,11 @@ func (bc *Blockchain) FindUTXO() map[string]TXOutputs {
 
 		Outputs:
 			for outIdx, out := range tx.Vout {
+				// OP_RETURN的输出永远不能花费, 不放进UTXO集合
+				if out.ScriptPubKey.IsUnspendable() {
+					continue
+				}
+
 				// Was the output spent?
 				if spentTXOs[txID] != nil {
 					for _, spentOut := range spentTXOs[txID] {
@@ -310,8 +356,11 @@ func (bc *Blockchain) FindUTXO() map[string]TXOutputs {
 					}
 				}
 
-				outs := UTXO[txID]
-				outs.Outputs = append(outs.Outputs, out)
+				outs, ok := UTXO[txID]
+				if !ok {
+					outs = TXOutputs{make(map[int]TXOutput)}
+				}
+				outs.Outputs[outIdx] = out
 				UTXO[txID] = outs
 			}
 
@@ -329,13 +378,27 @@ func (bc *Blockchain) FindUTXO() map[string]TXOutputs {
 		}
 	}
 
-	log.Printf("\nUTXO: %s\n", UTXO)
-
 	return UTXO
 }
 
 // FindTransaction 输入交易hash找到交易数据
 func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
+	block, err := bc.FindTransactionBlock(ID)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	for _, tx := range block.Transactions {
+		if bytes.Compare(tx.ID, ID) == 0 {
+			return *tx, nil
+		}
+	}
+
+	return Transaction{}, errors.New("Transaction is not found")
+}
+
+// FindTransactionBlock 输入交易hash找到包含这个交易的区块
+func (bc *Blockchain) FindTransactionBlock(ID []byte) (*Block, error) {
 	bci := bc.Iterator()
 
 	for {
@@ -343,7 +406,7 @@ func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
 
 		for _, tx := range block.Transactions {
 			if bytes.Compare(tx.ID, ID) == 0 {
-				return *tx, nil
+				return block, nil
 			}
 		}
 
@@ -352,7 +415,32 @@ func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
 		}
 	}
 
-	return Transaction{}, errors.New("Transaction is not found")
+	return nil, errors.New("Transaction is not found")
+}
+
+// FindPrevTransactions 找到交易的输入引用的所有交易, 找不到时返回错误
+func (bc *Blockchain) FindPrevTransactions(tx *Transaction) (map[string]Transaction, error) {
+	prevTXs := make(map[string]Transaction)
+
+	for _, vin := range tx.Vin {
+		prevTX, err := bc.FindTransaction(vin.Txid)
+		if err != nil {
+			return nil, fmt.Errorf("Input %x:%d: %s", vin.Txid, vin.Vout, err)
+		}
+		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+	}
+
+	return prevTXs, nil
+}
+
+// CalcTxFee 计算交易的手续费, 输入引用的交易都必须在链上
+func (bc *Blockchain) CalcTxFee(tx *Transaction) (int, error) {
+	prevTXs, err := bc.FindPrevTransactions(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	return CheckTransactionInputs(tx, prevTXs)
 }
 
 // SignTransaction 对交易进行签名
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+)
+
+// medianTimeBlocks 计算区块时间中位数(median time past)用到的区块数量
+const medianTimeBlocks = 11
+
+// Checkpoint 一个已知的区块高度和对应的区块hash
+type Checkpoint struct {
+	Height int
+	Hash   string
+}
+
+// ChainParams 每个网络各自的共识参数
+type ChainParams struct {
+	Name string
+
+	// Net 每条消息开头的网络标识, 不同网络的节点不会互相接受消息
+	Net uint32
+
+	// Checkpoints 按高度从低到高排列, 与之冲突的链一律拒绝
+	Checkpoints []Checkpoint
+
+	// AssumeValid 该区块(以及它的祖先)里面的交易签名在同步时不再验证, 为空表示全部验证
+	AssumeValid       string
+	AssumeValidHeight int
+
+	// MaxFutureBlockTime 区块时间最多可以比网络调整后的时间超前多少秒
+	MaxFutureBlockTime int64
+
+	// MaxBlockSize 序列化之后区块的最大字节数, 同时也限制了区块里面交易的数量
+	MaxBlockSize int
+	// MaxTxSize 序列化之后单个交易的最大字节数
+	MaxTxSize int
+
+	// MaxDataCarrierSize OP_RETURN输出最多携带的字节数
+	MaxDataCarrierSize int
+}
+
+// mainNetParams 对应db目录里面发布的那条链
+var mainNetParams = ChainParams{
+	Name: "main",
+	Net:  0xd9b4bef9,
+	Checkpoints: []Checkpoint{
+		{0, "00000068de90567c4a03f5270c03ea479d78e69129f66666cdd57a64e4114394"},
+	},
+	AssumeValid:        "000000c20f5961a9ce4a3e2330ccde8dc3a90dd76a788cf13d96d2d5737cf977",
+	AssumeValidHeight:  4,
+	MaxFutureBlockTime: 2 * 60 * 60,
+	MaxBlockSize:       1000000,
+	MaxTxSize:          100000,
+	MaxDataCarrierSize: 80,
+}
+
+// testNetParams 用于本地自己创建的链, 没有检查点
+var testNetParams = ChainParams{
+	Name:               "test",
+	Net:                0x0709110b,
+	MaxFutureBlockTime: 2 * 60 * 60,
+	MaxBlockSize:       1000000,
+	MaxTxSize:          100000,
+	MaxDataCarrierSize: 80,
+}
+
+// activeNetParams 当前节点使用的网络参数, 通过NETWORK环境变量选择
+var activeNetParams = &mainNetParams
+
+// SelectNetParams 根据名字切换当前网络, 名字为空时使用main
+func SelectNetParams(name string) error {
+	switch name {
+	case "", mainNetParams.Name:
+		activeNetParams = &mainNetParams
+	case testNetParams.Name:
+		activeNetParams = &testNetParams
+	default:
+		return fmt.Errorf("Unknown network: %s", name)
+	}
+
+	return nil
+}
+
+// checkpointAt 返回该高度上的检查点hash
+func (p *ChainParams) checkpointAt(height int) ([]byte, bool) {
+	for _, cp := range p.Checkpoints {
+		if cp.Height == height {
+			hash, err := hex.DecodeString(cp.Hash)
+			if err != nil {
+				panic(err)
+			}
+			return hash, true
+		}
+	}
+
+	return nil, false
+}
@@ -6,7 +6,10 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type CLI struct {
@@ -17,11 +20,35 @@ func (cli *CLI) printUsage() {
 	fmt.Println("Usage:")
 	fmt.Println("  showwallet - Show address and privete from wallet file")
 	fmt.Println("  createwallet - Generates a new key-pair and saves it into the wallet file")
-	fmt.Println("  getbalance -address ADDRESS - Get balance of ADDRESS")
+	fmt.Println("  getbalance [-address ADDRESS] - Get balance of ADDRESS including its change addresses, or of every address in the wallet")
 	fmt.Println("  createblockchain -address ADDRESS - Create a blockchain and send genesis block reward to ADDRESS")
 	fmt.Println("  printchain - Print all the blocks of the blockchain")
-	fmt.Println("  send -from FROM -to TO -amount AMOUNT - Send AMOUNT of coins from FROM address to TO")
-	fmt.Println("  startnode -miner ADDRESS - Start a node with ID specified in NODE_ID env. var. -miner enables mining")
+	fmt.Println("  send -from FROM -to TO -amount AMOUNT [-mine] [-locktime LOCKTIME] [-fee FEE] [-coinselect STRATEGY] [-inputs TXID:VOUT,...] [-reusechange] [-replaceable] [-data HEX] - Send AMOUNT of coins from FROM address to TO, spendable after LOCKTIME (block height, or unix time if >= 500000000), -data attaches an OP_RETURN output")
+	fmt.Println("  notarize -from FROM -file PATH [-fee FEE] [-reusechange] [-mine] - Anchor the SHA-256 of a file on the chain in an OP_RETURN output, -mine mines it immediately on this node")
+	fmt.Println("  lookupdata -hex DATA | -file PATH - Find the block and time of the OP_RETURN output carrying DATA, or the SHA-256 of a file")
+	fmt.Println("  sendmany -from FROM -to ADDRESS:AMOUNT,... | -file PATH [-mine] [-locktime LOCKTIME] [-fee FEE] [-coinselect STRATEGY] [-inputs TXID:VOUT,...] [-reusechange] [-replaceable] - Send to many recipients in one transaction, PATH is a CSV (address,amount) or JSON file")
+	fmt.Println("  bumpfee -txid TXID [-fee FEE] - Replace an unconfirmed replaceable wallet transaction with one paying FEE, taken from its change (default: old fee plus the minimum relay fee)")
+	fmt.Println("  createmultisig -m M -keys KEY1,KEY2,... - Create an M-of-N multisig address from hex public keys or wallet addresses")
+	fmt.Println("  spendmultisig -from ADDRESS -to TO -amount AMOUNT [-redeemscript SCRIPT] - Build a transaction spending from a multisig address and add this wallet's signatures")
+	fmt.Println("  signmultisig -tx TX [-send] - Add this wallet's signatures to a multisig transaction, -send broadcasts it once complete")
+	fmt.Println("  createrawtx -from FROM -to TO -amount AMOUNT [-locktime LOCKTIME] [-redeemscript SCRIPT] - Build an unsigned transaction without private keys")
+	fmt.Println("  signrawtx -tx PSBT - Add this wallet's signatures to a partially signed transaction, works offline")
+	fmt.Println("  combinerawtx -txs PSBT1,PSBT2,... - Merge the signatures of several copies of a partially signed transaction")
+	fmt.Println("  sendrawtx -tx PSBT - Finalize a fully signed transaction, verify it and broadcast it")
+	fmt.Println("  createrawtransaction -inputs TXID:VOUT,... -outputs ADDRESS:AMOUNT,... [-locktime LOCKTIME] [-sign] - Build a transaction from explicit inputs and outputs and print it as hex, -sign signs it with the wallet")
+	fmt.Println("  decoderawtransaction [-json] HEX - Show a hex-encoded transaction")
+	fmt.Println("  sendrawtransaction [-skipcheck] HEX - Verify a hex-encoded transaction against the local chain and broadcast it, -skipcheck sends it unverified")
+	fmt.Println("  decodescript -hex SCRIPT - Disassemble a hex-encoded script and show its type and addresses")
+	fmt.Println("  startnode -miner ADDRESS [-listen HOST] [-port PORT] [-externalip ADDR] [-datadir DIR] [-connect ADDR,...] [-addnode ADDR,...] [-conf FILE] [-dust VALUE] [-minrelayfee FEE] [-maxstdtxsize BYTES] [-outputtypes TYPE,...] [-maxmempool BYTES] [-mempoolexpiry HOURS] - Start a node with ID specified in NODE_ID env. var. -miner enables mining, -listen/-port/-externalip set the network addresses, -connect/-addnode/-conf choose the peers, the other options set the relay policy and mempool limits")
+	fmt.Println("  getmempoolinfo - Show the transaction count, size, minimum fee rate and oldest entry of the mempool of the running node NODE_ID")
+	fmt.Println("  getpeerinfo - Show the connected peers of the running node NODE_ID with their version, best height and traffic")
+	fmt.Println("Coin selection strategies: largest (default), smallest, bnb, random. -inputs spends exactly the given outputs")
+	fmt.Println("Change goes to a new wallet address unless -reusechange is given; balances of FROM include its change addresses")
+	fmt.Println("Environment:")
+	fmt.Println("  NODE_ID - Node ID, used in the data file names and as the default port")
+	fmt.Println("  DATA_DIR - Directory of the data files (default db), startnode -datadir overrides it")
+	fmt.Println("  NODE_ADDR - Address of the running node that sends, getmempoolinfo and getpeerinfo talk to (default localhost:NODE_ID)")
+	fmt.Println("  NETWORK - main (default) or test; selects the checkpoints and assume-valid block")
 }
 
 func (cli *CLI) validateArgs() {
@@ -40,6 +67,20 @@ func (cli *CLI) Run() {
 		os.Exit(1)
 	}
 
+	err := SelectNetParams(os.Getenv("NETWORK"))
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		os.Exit(1)
+	}
+
+	if dir := os.Getenv("DATA_DIR"); dir != "" {
+		dataDir = dir
+		err = os.MkdirAll(dataDir, 0700)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
 	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
 
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
@@ -57,9 +98,104 @@ func (cli *CLI) Run() {
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
 	sendMine := sendCmd.Bool("mine", false, "Mine immediately on the same node")
+	sendLockTime := sendCmd.Uint("locktime", 0, "Block height or unix time before which the transaction can not be mined")
+	sendFee := sendCmd.Int("fee", 0, "Fee paid to the miner")
+	sendCoinSelect := sendCmd.String("coinselect", "", "Coin selection strategy: largest, smallest, bnb or random")
+	sendInputs := sendCmd.String("inputs", "", "Comma separated txid:vout outputs to spend instead of selecting coins")
+	sendReuseChange := sendCmd.Bool("reusechange", false, "Send the change back to FROM instead of a new change address")
+	sendData := sendCmd.String("data", "", "Hex data to carry in an OP_RETURN output")
+	sendReplaceable := sendCmd.Bool("replaceable", false, "Allow the transaction to be replaced by bumpfee before it is confirmed")
+
+	notarizeCmd := flag.NewFlagSet("notarize", flag.ExitOnError)
+	notarizeFrom := notarizeCmd.String("from", "", "Wallet address paying the fee")
+	notarizeFile := notarizeCmd.String("file", "", "File whose SHA-256 is anchored")
+	notarizeFee := notarizeCmd.Int("fee", 0, "Fee paid to the miner")
+	notarizeMine := notarizeCmd.Bool("mine", false, "Mine immediately on the same node")
+	notarizeReuseChange := notarizeCmd.Bool("reusechange", false, "Send the change back to FROM instead of a new change address")
+
+	lookupDataCmd := flag.NewFlagSet("lookupdata", flag.ExitOnError)
+	lookupDataHex := lookupDataCmd.String("hex", "", "Hex data carried by the OP_RETURN output")
+	lookupDataFile := lookupDataCmd.String("file", "", "File whose SHA-256 is looked up")
+
+	sendManyCmd := flag.NewFlagSet("sendmany", flag.ExitOnError)
+	sendManyFrom := sendManyCmd.String("from", "", "Source wallet address")
+	sendManyTo := sendManyCmd.String("to", "", "Comma separated address:amount recipients")
+	sendManyFile := sendManyCmd.String("file", "", "CSV or JSON file with the recipients")
+	sendManyMine := sendManyCmd.Bool("mine", false, "Mine immediately on the same node")
+	sendManyLockTime := sendManyCmd.Uint("locktime", 0, "Block height or unix time before which the transaction can not be mined")
+	sendManyFee := sendManyCmd.Int("fee", 0, "Fee paid to the miner")
+	sendManyCoinSelect := sendManyCmd.String("coinselect", "", "Coin selection strategy: largest, smallest, bnb or random")
+	sendManyInputs := sendManyCmd.String("inputs", "", "Comma separated txid:vout outputs to spend instead of selecting coins")
+	sendManyReuseChange := sendManyCmd.Bool("reusechange", false, "Send the change back to FROM instead of a new change address")
+	sendManyReplaceable := sendManyCmd.Bool("replaceable", false, "Allow the transaction to be replaced by bumpfee before it is confirmed")
+
+	bumpFeeCmd := flag.NewFlagSet("bumpfee", flag.ExitOnError)
+	bumpFeeTxid := bumpFeeCmd.String("txid", "", "Id of the unconfirmed wallet transaction")
+	bumpFeeFee := bumpFeeCmd.Int("fee", 0, "New total fee, must be higher than the old one")
+
+	createMultisigCmd := flag.NewFlagSet("createmultisig", flag.ExitOnError)
+	createMultisigM := createMultisigCmd.Int("m", 0, "Number of required signatures")
+	createMultisigKeys := createMultisigCmd.String("keys", "", "Comma separated hex public keys or wallet addresses")
+
+	spendMultisigCmd := flag.NewFlagSet("spendmultisig", flag.ExitOnError)
+	spendMultisigFrom := spendMultisigCmd.String("from", "", "Source multisig address")
+	spendMultisigTo := spendMultisigCmd.String("to", "", "Destination wallet address")
+	spendMultisigAmount := spendMultisigCmd.Int("amount", 0, "Amount to send")
+	spendMultisigRedeemScript := spendMultisigCmd.String("redeemscript", "", "Hex redeem script, if it is not stored in the wallet")
+
+	signMultisigCmd := flag.NewFlagSet("signmultisig", flag.ExitOnError)
+	signMultisigTx := signMultisigCmd.String("tx", "", "Hex transaction with the signatures collected so far")
+	signMultisigSend := signMultisigCmd.Bool("send", false, "Broadcast the transaction once it is fully signed")
+
+	createRawTxCmd := flag.NewFlagSet("createrawtx", flag.ExitOnError)
+	createRawTxFrom := createRawTxCmd.String("from", "", "Source wallet or multisig address")
+	createRawTxTo := createRawTxCmd.String("to", "", "Destination wallet address")
+	createRawTxAmount := createRawTxCmd.Int("amount", 0, "Amount to send")
+	createRawTxLockTime := createRawTxCmd.Uint("locktime", 0, "Block height or unix time before which the transaction can not be mined")
+	createRawTxRedeemScript := createRawTxCmd.String("redeemscript", "", "Hex redeem script, if it is not stored in the wallet")
+
+	signRawTxCmd := flag.NewFlagSet("signrawtx", flag.ExitOnError)
+	signRawTxTx := signRawTxCmd.String("tx", "", "Hex partially signed transaction")
+
+	combineRawTxCmd := flag.NewFlagSet("combinerawtx", flag.ExitOnError)
+	combineRawTxTxs := combineRawTxCmd.String("txs", "", "Comma separated hex partially signed transactions")
+
+	sendRawTxCmd := flag.NewFlagSet("sendrawtx", flag.ExitOnError)
+	sendRawTxTx := sendRawTxCmd.String("tx", "", "Hex fully signed partially signed transaction")
+
+	createRawTransactionCmd := flag.NewFlagSet("createrawtransaction", flag.ExitOnError)
+	createRawTransactionInputs := createRawTransactionCmd.String("inputs", "", "Comma separated txid:vout inputs")
+	createRawTransactionOutputs := createRawTransactionCmd.String("outputs", "", "Comma separated address:amount outputs")
+	createRawTransactionLockTime := createRawTransactionCmd.Uint("locktime", 0, "Block height or unix time before which the transaction can not be mined")
+	createRawTransactionSign := createRawTransactionCmd.Bool("sign", false, "Sign the inputs with the keys in the wallet")
+
+	decodeRawTransactionCmd := flag.NewFlagSet("decoderawtransaction", flag.ExitOnError)
+	decodeRawTransactionJSON := decodeRawTransactionCmd.Bool("json", false, "Print the transaction as JSON")
+
+	sendRawTransactionCmd := flag.NewFlagSet("sendrawtransaction", flag.ExitOnError)
+	sendRawTransactionSkipCheck := sendRawTransactionCmd.Bool("skipcheck", false, "Broadcast without verifying the transaction")
+
+	decodeScriptCmd := flag.NewFlagSet("decodescript", flag.ExitOnError)
+	decodeScriptHex := decodeScriptCmd.String("hex", "", "Hex-encoded script")
 
 	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
 	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining mode and send reward to ADDRESS")
+	startNodeDust := startNodeCmd.Int("dust", DefaultPolicy.DustThreshold, "Outputs below this value are not relayed")
+	startNodeMinRelayFee := startNodeCmd.Int("minrelayfee", DefaultPolicy.MinRelayFee, "Minimum fee per 1000 bytes for relaying transactions")
+	startNodeMaxStdTxSize := startNodeCmd.Int("maxstdtxsize", DefaultPolicy.MaxStandardTxSize, "Largest transaction in bytes that is relayed")
+	startNodeOutputTypes := startNodeCmd.String("outputtypes", "pubkeyhash,scripthash,multisig,nulldata", "Comma separated output types that are relayed")
+	startNodeMaxMempool := startNodeCmd.Int("maxmempool", DefaultMaxMempoolBytes, "Largest size of the mempool in bytes, the lowest fee rate transactions are evicted above it")
+	startNodeMempoolExpiry := startNodeCmd.Int("mempoolexpiry", int(DefaultMempoolExpiry/time.Hour), "Hours a transaction can stay in the mempool")
+	startNodeConnect := startNodeCmd.String("connect", "", "Comma separated addresses, connect only to these nodes")
+	startNodeAddNode := startNodeCmd.String("addnode", "", "Comma separated addresses of nodes to connect to at startup")
+	startNodeConf := startNodeCmd.String("conf", "", "Config file with KEY=VALUE lines for listen, port, externalip, connect and addnode (default DATADIR/"+fmt.Sprintf(nodeConfigFile, "NODE_ID")+")")
+	startNodeListen := startNodeCmd.String("listen", "", "Host or IP to listen on, e.g. 127.0.0.2 (default localhost)")
+	startNodePort := startNodeCmd.String("port", "", "Port to listen on (default NODE_ID)")
+	startNodeExternalIP := startNodeCmd.String("externalip", "", "Address[:port] other nodes should connect to, sent in version messages (default the listen address)")
+	startNodeDataDir := startNodeCmd.String("datadir", "", "Directory of the blockchain, wallet, mempool and config files (default DATA_DIR or db)")
+
+	getMempoolInfoCmd := flag.NewFlagSet("getmempoolinfo", flag.ExitOnError)
+	getPeerInfoCmd := flag.NewFlagSet("getpeerinfo", flag.ExitOnError)
 
 	switch os.Args[1] {
 	case "startnode":
@@ -67,6 +203,16 @@ func (cli *CLI) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "getmempoolinfo":
+		err := getMempoolInfoCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getpeerinfo":
+		err := getPeerInfoCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "showwallet":
 		err := showWalletCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -87,6 +233,21 @@ func (cli *CLI) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "notarize":
+		err := notarizeCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "lookupdata":
+		err := lookupDataCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "sendmany":
+		err := sendManyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "createblockchain":
 		err := createBlockchainCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -94,6 +255,66 @@ func (cli *CLI) Run() {
 		}
 	case "printchain":
 		printChainCmd.Parse(os.Args[2:])
+	case "bumpfee":
+		err := bumpFeeCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "createmultisig":
+		err := createMultisigCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "spendmultisig":
+		err := spendMultisigCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "signmultisig":
+		err := signMultisigCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "createrawtx":
+		err := createRawTxCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "signrawtx":
+		err := signRawTxCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "combinerawtx":
+		err := combineRawTxCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "sendrawtx":
+		err := sendRawTxCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "createrawtransaction":
+		err := createRawTransactionCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "decoderawtransaction":
+		err := decodeRawTransactionCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "sendrawtransaction":
+		err := sendRawTransactionCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "decodescript":
+		err := decodeScriptCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "h":
 		cli.printUsage()
 		return
@@ -110,10 +331,6 @@ func (cli *CLI) Run() {
 	}
 
 	if getBalanceCmd.Parsed() {
-		if *getBalanceAddress == "" {
-			getBalanceCmd.Usage()
-			os.Exit(1)
-		}
 		cli.getBalance(*getBalanceAddress, nodeID)
 	}
 
@@ -122,7 +339,81 @@ func (cli *CLI) Run() {
 			sendCmd.Usage()
 			os.Exit(1)
 		}
-		cli.send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine)
+		if *sendLockTime > MaxSequence || *sendFee < 0 {
+			sendCmd.Usage()
+			os.Exit(1)
+		}
+		opts := newSendOptions(uint32(*sendLockTime), *sendFee, *sendCoinSelect, *sendInputs)
+		opts.Replaceable = *sendReplaceable
+		if *sendData != "" {
+			data, err := hex.DecodeString(*sendData)
+			if err != nil {
+				log.Panic(err)
+			}
+			opts.Data = data
+		}
+		cli.send(*sendFrom, *sendTo, *sendAmount, opts, *sendReuseChange, nodeID, *sendMine)
+	}
+
+	if notarizeCmd.Parsed() {
+		if *notarizeFrom == "" || *notarizeFile == "" || *notarizeFee < 0 {
+			notarizeCmd.Usage()
+			os.Exit(1)
+		}
+		cli.notarize(*notarizeFrom, *notarizeFile, SendOptions{Fee: *notarizeFee}, *notarizeReuseChange, nodeID, *notarizeMine)
+	}
+
+	if lookupDataCmd.Parsed() {
+		if (*lookupDataHex == "") == (*lookupDataFile == "") {
+			lookupDataCmd.Usage()
+			os.Exit(1)
+		}
+
+		var data []byte
+		if *lookupDataFile != "" {
+			hash := fileHash(*lookupDataFile)
+			data = hash[:]
+		} else {
+			var err error
+			data, err = hex.DecodeString(*lookupDataHex)
+			if err != nil {
+				log.Panic(err)
+			}
+		}
+		cli.lookupData(data, nodeID)
+	}
+
+	if sendManyCmd.Parsed() {
+		if *sendManyFrom == "" || (*sendManyTo == "") == (*sendManyFile == "") || *sendManyLockTime > MaxSequence || *sendManyFee < 0 {
+			sendManyCmd.Usage()
+			os.Exit(1)
+		}
+
+		var recipients []Recipient
+		var err error
+		if *sendManyFile != "" {
+			recipients, err = loadRecipients(*sendManyFile)
+		} else {
+			recipients, err = parseRecipients(*sendManyTo)
+		}
+		if err != nil {
+			log.Panic(err)
+		}
+		if len(recipients) == 0 {
+			log.Panic("ERROR: No recipients")
+		}
+
+		opts := newSendOptions(uint32(*sendManyLockTime), *sendManyFee, *sendManyCoinSelect, *sendManyInputs)
+		opts.Replaceable = *sendManyReplaceable
+		cli.sendMany(*sendManyFrom, recipients, opts, *sendManyReuseChange, nodeID, *sendManyMine)
+	}
+
+	if bumpFeeCmd.Parsed() {
+		if *bumpFeeTxid == "" || *bumpFeeFee < 0 {
+			bumpFeeCmd.Usage()
+			os.Exit(1)
+		}
+		cli.bumpFee(*bumpFeeTxid, *bumpFeeFee, nodeID)
 	}
 
 	if printChainCmd.Parsed() {
@@ -137,13 +428,186 @@ func (cli *CLI) Run() {
 		cli.createBlockChain(*createBlockchainAddress, nodeID)
 	}
 
+	if createMultisigCmd.Parsed() {
+		if *createMultisigM <= 0 || *createMultisigKeys == "" {
+			createMultisigCmd.Usage()
+			os.Exit(1)
+		}
+		cli.createMultisig(*createMultisigM, strings.Split(*createMultisigKeys, ","), nodeID)
+	}
+
+	if spendMultisigCmd.Parsed() {
+		if *spendMultisigFrom == "" || *spendMultisigTo == "" || *spendMultisigAmount <= 0 {
+			spendMultisigCmd.Usage()
+			os.Exit(1)
+		}
+		cli.spendMultisig(*spendMultisigFrom, *spendMultisigTo, *spendMultisigAmount, *spendMultisigRedeemScript, nodeID)
+	}
+
+	if signMultisigCmd.Parsed() {
+		if *signMultisigTx == "" {
+			signMultisigCmd.Usage()
+			os.Exit(1)
+		}
+		cli.signMultisig(*signMultisigTx, nodeID, *signMultisigSend)
+	}
+
+	if createRawTxCmd.Parsed() {
+		if *createRawTxFrom == "" || *createRawTxTo == "" || *createRawTxAmount <= 0 || *createRawTxLockTime > MaxSequence {
+			createRawTxCmd.Usage()
+			os.Exit(1)
+		}
+		cli.createRawTx(*createRawTxFrom, *createRawTxTo, *createRawTxAmount, uint32(*createRawTxLockTime), *createRawTxRedeemScript, nodeID)
+	}
+
+	if signRawTxCmd.Parsed() {
+		if *signRawTxTx == "" {
+			signRawTxCmd.Usage()
+			os.Exit(1)
+		}
+		cli.signRawTx(*signRawTxTx, nodeID)
+	}
+
+	if combineRawTxCmd.Parsed() {
+		if *combineRawTxTxs == "" {
+			combineRawTxCmd.Usage()
+			os.Exit(1)
+		}
+		cli.combineRawTx(strings.Split(*combineRawTxTxs, ","))
+	}
+
+	if sendRawTxCmd.Parsed() {
+		if *sendRawTxTx == "" {
+			sendRawTxCmd.Usage()
+			os.Exit(1)
+		}
+		cli.sendRawTx(*sendRawTxTx, nodeID)
+	}
+
+	if createRawTransactionCmd.Parsed() {
+		if *createRawTransactionInputs == "" || *createRawTransactionOutputs == "" || *createRawTransactionLockTime > MaxSequence {
+			createRawTransactionCmd.Usage()
+			os.Exit(1)
+		}
+		cli.createRawTransaction(strings.Split(*createRawTransactionInputs, ","), strings.Split(*createRawTransactionOutputs, ","), uint32(*createRawTransactionLockTime), *createRawTransactionSign, nodeID)
+	}
+
+	if decodeRawTransactionCmd.Parsed() {
+		if decodeRawTransactionCmd.NArg() != 1 {
+			decodeRawTransactionCmd.Usage()
+			os.Exit(1)
+		}
+		cli.decodeRawTransaction(decodeRawTransactionCmd.Arg(0), *decodeRawTransactionJSON)
+	}
+
+	if sendRawTransactionCmd.Parsed() {
+		if sendRawTransactionCmd.NArg() != 1 {
+			sendRawTransactionCmd.Usage()
+			os.Exit(1)
+		}
+		cli.sendRawTransaction(sendRawTransactionCmd.Arg(0), *sendRawTransactionSkipCheck, nodeID)
+	}
+
+	if decodeScriptCmd.Parsed() {
+		if *decodeScriptHex == "" {
+			decodeScriptCmd.Usage()
+			os.Exit(1)
+		}
+		cli.decodeScript(*decodeScriptHex)
+	}
+
 	if startNodeCmd.Parsed() {
 		nodeID := os.Getenv("NODE_ID")
 		if nodeID == "" {
 			startNodeCmd.Usage()
 			os.Exit(1)
 		}
-		cli.startNode(nodeID, *startNodeMiner)
+		outputTypes, err := ParseOutputTypes(*startNodeOutputTypes)
+		if err != nil {
+			log.Panic(err)
+		}
+		if *startNodeMaxMempool <= 0 || *startNodeMempoolExpiry <= 0 {
+			startNodeCmd.Usage()
+			os.Exit(1)
+		}
+		if *startNodeDataDir != "" {
+			dataDir = *startNodeDataDir
+		}
+		confPath := *startNodeConf
+		if confPath == "" {
+			confPath = dataFile(nodeConfigFile, nodeID)
+		}
+		config, err := LoadNodeConfig(confPath)
+		if err != nil {
+			log.Panic(err)
+		}
+		// 命令行参数优先于配置文件
+		config.Connect = append(config.Connect, parseNodeList(*startNodeConnect)...)
+		config.AddNode = append(config.AddNode, parseNodeList(*startNodeAddNode)...)
+		if *startNodeListen != "" {
+			config.Listen = *startNodeListen
+		}
+		if *startNodePort != "" {
+			config.Port = *startNodePort
+		}
+		if *startNodeExternalIP != "" {
+			config.ExternalIP = *startNodeExternalIP
+		}
+		if config.Listen == "" {
+			config.Listen = "localhost"
+		}
+		if config.Port == "" {
+			config.Port = nodeID
+		}
+
+		policy := Policy{*startNodeDust, *startNodeMaxStdTxSize, *startNodeMinRelayFee, outputTypes}
+		mempool.SetLimits(*startNodeMaxMempool, time.Duration(*startNodeMempoolExpiry)*time.Hour)
+		cli.startNode(nodeID, *startNodeMiner, policy, config)
+	}
+
+	if getMempoolInfoCmd.Parsed() {
+		cli.getMempoolInfo(nodeID)
+	}
+
+	if getPeerInfoCmd.Parsed() {
+		cli.getPeerInfo(nodeID)
+	}
+}
+
+// getMempoolInfo 打印正在运行的节点NODE_ID的交易池信息
+func (cli *CLI) getMempoolInfo(nodeID string) {
+	info := getMempoolInfo(nodeID)
+
+	fmt.Printf("Transactions: %d\n", info.Count)
+	fmt.Printf("Bytes:        %d / %d\n", info.Bytes, info.MaxBytes)
+	fmt.Printf("Min fee rate: %d per 1000 bytes\n", info.MinFeeRate)
+	fmt.Printf("Expiry:       %s\n", info.Expiry)
+	if info.Count > 0 {
+		fmt.Printf("Oldest entry: %s (%s ago)\n", info.Oldest.Format(time.RFC3339), time.Since(info.Oldest).Round(time.Second))
+	}
+}
+
+// getPeerInfo 打印正在运行的节点NODE_ID当前的连接
+func (cli *CLI) getPeerInfo(nodeID string) {
+	infos := getPeerInfo(nodeID)
+
+	fmt.Printf("%d peers\n", len(infos))
+	for _, info := range infos {
+		direction := "outbound"
+		if info.Inbound {
+			direction = "inbound"
+		}
+		fmt.Printf("============ %s (%s) ============\n", info.Addr, direction)
+		if !info.HandshakeDone {
+			fmt.Println("Handshake:   in progress")
+		}
+		fmt.Printf("Listen addr: %s\n", info.ListenAddr)
+		fmt.Printf("Version:     %d\n", info.Version)
+		fmt.Printf("Services:    %d\n", info.Services)
+		fmt.Printf("Best height: %d\n", info.BestHeight)
+		fmt.Printf("Connected:   %s ago\n", time.Since(info.ConnTime).Round(time.Second))
+		fmt.Printf("Sent:        %d bytes in %d messages\n", info.BytesSent, info.MsgsSent)
+		fmt.Printf("Received:    %d bytes in %d messages\n", info.BytesRecv, info.MsgsRecv)
 	}
 }
 
@@ -160,6 +624,9 @@ func (cli *CLI) showWallet(nodeID string) {
 
 	for address, w := range wallets.Wallets {
 		fmt.Printf("Your new address: %v \nprivate: %x\n", address, w.PrivateKey.D.Bytes())
+		if wallets.IsChange(address) {
+			fmt.Printf("change of: %s\n", wallets.GetOwner(address))
+		}
 		fmt.Printf("public: %s\n", hex.EncodeToString(w.PublicKey))
 		fmt.Printf("public hash: %s\n\n", hex.EncodeToString(HashPubKey(w.PublicKey)))
 		//fmt.Printf("public: %s\n\n", Base58Encode(append(append([]byte{0x00}, HashPubKey(w.PublicKey)...), []byte{0x00, 0x00, 0x00, 0x00}...)))
@@ -167,25 +634,61 @@ func (cli *CLI) showWallet(nodeID string) {
 	}
 }
 
+// getBalance 打印address的余额, 包括它的找零地址; address为空时打印钱包里面每个地址的余额
 func (cli *CLI) getBalance(address string, nodeID string) {
-	if !ValidateAddress(address) {
+	if address != "" && !ValidateAddress(address) {
 		log.Panic("ERROR: Address is not valid")
 	}
 
 	bc := NewBlockchain(nodeID)
 	defer bc.db.Close()
 
-	balance := 0
 	us := UTXOSet{bc}
 	//us.Reindex()
-	UTXOs := us.FindUTXO(HashPubKeyFromAddress([]byte(address)))
+	wallets, _ := NewWallets(nodeID)
 
-	for _, out := range UTXOs {
-		balance += out.Value
+	owners := []string{address}
+	if address == "" {
+		owners = nil
+		for _, addr := range wallets.GetAddresses() {
+			if !wallets.IsChange(addr) {
+				owners = append(owners, addr)
+			}
+		}
+		sort.Strings(owners)
 	}
 
-	fmt.Printf("Balance of '%s': %d\n", address, balance)
+	total := 0
+	for _, owner := range owners {
+		balance := addressBalance(us, owner)
+		for _, changeAddress := range wallets.GetChangeAddresses(owner) {
+			changeBalance := addressBalance(us, changeAddress)
+			fmt.Printf("  change '%s': %d\n", changeAddress, changeBalance)
+			balance += changeBalance
+		}
+
+		fmt.Printf("Balance of '%s': %d\n", owner, balance)
+		total += balance
+	}
 
+	if address == "" {
+		fmt.Printf("Total: %d\n", total)
+	}
+}
+
+// addressBalance 返回单个地址的未花费输出的金额之和
+func addressBalance(us UTXOSet, address string) int {
+	lockingScript, err := PayToAddrScript(address)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	balance := 0
+	for _, out := range us.FindUTXO(lockingScript) {
+		balance += out.Value
+	}
+
+	return balance
 }
 
 func (cli *CLI) createBlockChain(address string, nodeID string) {
@@ -198,13 +701,53 @@ func (cli *CLI) createBlockChain(address string, nodeID string) {
 	fmt.Println("Done!")
 }
 
-func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool) {
-	if !ValidateAddress(from) {
-		log.Panic("ERROR: Sender address is not valid")
+// newSendOptions 把send和sendmany的命令行参数转换成SendOptions
+func newSendOptions(lockTime uint32, fee int, coinSelect, inputs string) SendOptions {
+	selector, err := NewCoinSelector(coinSelect)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	opts := SendOptions{LockTime: lockTime, Fee: fee, CoinSelector: selector}
+	if inputs != "" {
+		opts.Outpoints, err = parseOutpoints(strings.Split(inputs, ","))
+		if err != nil {
+			log.Panic(err)
+		}
 	}
+
+	return opts
+}
+
+// prepareChange from以前的找零地址也可以用来支付, reuseChange为false时再生成一个新的找零地址
+// 返回新的找零地址, 没有生成时返回空字符串
+func prepareChange(wallets *Wallets, from string, opts *SendOptions, reuseChange bool) string {
+	opts.FundingAddresses = wallets.GetChangeAddresses(from)
+
+	// 多重签名地址的找零还是回到原来的地址, 否则就不再需要多个签名了
+	if reuseChange || wallets.Wallets[from] == nil {
+		return ""
+	}
+
+	opts.ChangeAddress = wallets.NewChangeAddress(from)
+	return opts.ChangeAddress
+}
+
+func (cli *CLI) send(from, to string, amount int, opts SendOptions, reuseChange bool, nodeID string, mineNow bool) {
 	if !ValidateAddress(to) {
 		log.Panic("ERROR: Recipient address is not valid")
 	}
+
+	cli.submitTransaction(from, []Recipient{{to, amount}}, opts, reuseChange, nodeID, mineNow)
+
+	fmt.Println("Success!")
+}
+
+// submitTransaction 创建并签名从from发出的交易, mineNow为true时直接在本地挖矿, 否则发送给正在运行的节点(见nodeRPCAddress)
+func (cli *CLI) submitTransaction(from string, recipients []Recipient, opts SendOptions, reuseChange bool, nodeID string, mineNow bool) *Transaction {
+	if !ValidateAddress(from) {
+		log.Panic("ERROR: Sender address is not valid")
+	}
 	bc := NewBlockchain(nodeID)
 	UTXOSet := UTXOSet{bc}
 	defer bc.db.Close()
@@ -213,22 +756,50 @@ func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool) {
 	if err != nil {
 		log.Panic(err)
 	}
-	wallet := wallets.GetWallet(from)
+	changeAddress := prepareChange(wallets, from, &opts, reuseChange)
 
 	//下面创建tx的时候, 不需要使用新出的coinbaseTx.
-	tx := NewUTXOTransaction(&wallet, from, to, amount, &UTXOSet)
+	tx := NewSendManyTransaction(wallets, from, recipients, opts, &UTXOSet)
+
+	// 找零总是在收款人和OP_RETURN输出之后
+	changeIndex := len(recipients)
+	if opts.Data != nil {
+		changeIndex++
+	}
+	if changeIndex >= len(tx.Vout) {
+		changeIndex = -1
+	}
+	if changeIndex >= 0 && changeAddress != "" {
+		fmt.Printf("Change address: %s\n", changeAddress)
+	} else {
+		// 没有用到的找零地址直接丢弃
+		delete(wallets.Wallets, changeAddress)
+		delete(wallets.ChangeOwners, changeAddress)
+	}
+
 	if mineNow {
 		//发送交易的人顺便挖矿, 得到奖励.
 		cbTx := NewCoinbaseTX(from, "")
-		newBlock := bc.MineBlock([]*Transaction{cbTx, tx})
+		newBlock, err := bc.MineBlock([]*Transaction{cbTx, tx})
+		if err != nil {
+			log.Panic(err)
+		}
 		UTXOSet.Update(newBlock)
 	} else {
-		// 直接执行send的时候, 并没有设置过nodeAddress(执行StartServer时才有设置), 所以在这里设置
-		nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
-		sendTx(knownNodes[0], tx)
+		// 记录发出去的交易, 确认之前可以用bumpfee提高手续费
+		fee, err := bc.CalcTxFee(tx)
+		if err != nil {
+			log.Panic(err)
+		}
+		wallets.Transactions[hex.EncodeToString(tx.ID)] = WalletTx{*tx, fee, changeIndex}
 	}
+	wallets.SaveToFile(nodeID)
 
-	fmt.Println("Success!")
+	if !mineNow {
+		submitTx(nodeID, tx)
+	}
+
+	return tx
 }
 
 func (cli *CLI) printChain(nodeID string) {
@@ -255,7 +826,7 @@ func (cli *CLI) printChain(nodeID string) {
 	}
 }
 
-func (cli *CLI) startNode(nodeID, minerAddress string) {
+func (cli *CLI) startNode(nodeID, minerAddress string, policy Policy, config NodeConfig) {
 	fmt.Printf("Starting node %s\n", nodeID)
 	if len(minerAddress) > 0 {
 		if ValidateAddress(minerAddress) {
@@ -264,5 +835,6 @@ func (cli *CLI) startNode(nodeID, minerAddress string) {
 			log.Panic("Wrong miner address!")
 		}
 	}
-	StartServer(nodeID, minerAddress)
+	activePolicy = policy
+	StartServer(nodeID, minerAddress, config)
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+)
+
+// bumpFee 用手续费更高的交易替换钱包发出去还没有确认的交易txid, fee为0时在原来的手续费上加上最低转发手续费
+func (cli *CLI) bumpFee(txid string, fee int, nodeID string) {
+	bc := NewBlockchain(nodeID)
+	defer bc.db.Close()
+
+	wallets, err := NewWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	wtx, ok := wallets.Transactions[txid]
+	if !ok {
+		log.Panicf("ERROR: Transaction %s is not a wallet transaction", txid)
+	}
+	if _, err := bc.FindTransaction(wtx.Tx.ID); err == nil {
+		log.Panicf("ERROR: Transaction %s is already confirmed", txid)
+	}
+
+	if fee == 0 {
+		minFee := DefaultPolicy.MinFee(len(wtx.Tx.Serialize()))
+		if minFee < 1 {
+			minFee = 1
+		}
+		fee = wtx.Fee + minFee
+	}
+
+	bumped, err := NewFeeBumpTransaction(wtx, fee)
+	if err != nil {
+		log.Panic(err)
+	}
+	bumped.Tx = *wallets.SignTransaction(&bumped.Tx, bc)
+
+	newTxid := hex.EncodeToString(bumped.Tx.ID)
+	delete(wallets.Transactions, txid)
+	wallets.Transactions[newTxid] = *bumped
+	wallets.SaveToFile(nodeID)
+
+	submitTx(nodeID, &bumped.Tx)
+
+	fmt.Printf("Replaced %s (fee %d) with %s (fee %d)\n", txid, wtx.Fee, newTxid, bumped.Fee)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+)
+
+// notarize 把文件的SHA-256放进一个OP_RETURN输出, 手续费和找零照常处理
+func (cli *CLI) notarize(from, path string, opts SendOptions, reuseChange bool, nodeID string, mineNow bool) {
+	hash := fileHash(path)
+	opts.Data = hash[:]
+
+	tx := cli.submitTransaction(from, nil, opts, reuseChange, nodeID, mineNow)
+
+	fmt.Printf("Notarized %s (sha256 %x) in transaction %x\n", path, hash, tx.ID)
+}
+
+// lookupData 在链上查找携带data的OP_RETURN输出, 打印所在的区块和时间
+func (cli *CLI) lookupData(data []byte, nodeID string) {
+	bc := NewBlockchain(nodeID)
+	defer bc.db.Close()
+
+	found := false
+	bci := bc.Iterator()
+	for {
+		block := bci.Next()
+
+		for _, tx := range block.Transactions {
+			for outIdx, out := range tx.Vout {
+				carried, ok := ExtractNullData(out.ScriptPubKey)
+				if !ok || !bytes.Equal(carried, data) {
+					continue
+				}
+
+				found = true
+				fmt.Printf("Transaction: %x:%d\n", tx.ID, outIdx)
+				fmt.Printf("Block:       %x\n", block.Hash)
+				fmt.Printf("Height:      %d\n", block.Height)
+				fmt.Printf("Timestamp:   %d (%s)\n\n", block.Timestamp, time.Unix(block.Timestamp, 0).UTC().Format(time.RFC3339))
+			}
+		}
+
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+	}
+
+	if !found {
+		fmt.Printf("Data %x is not found\n", data)
+	}
+}
+
+// fileHash 返回文件内容的SHA-256
+func fileHash(path string) [32]byte {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return sha256.Sum256(content)
+}
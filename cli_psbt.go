@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+)
+
+// createRawTx 在联网的节点上创建还没有签名的交易, 不需要私钥
+func (cli *CLI) createRawTx(from, to string, amount int, lockTime uint32, redeemScriptHex string, nodeID string) {
+	if !ValidateAddress(from) {
+		log.Panic("ERROR: Sender address is not valid")
+	}
+	if !ValidateAddress(to) {
+		log.Panic("ERROR: Recipient address is not valid")
+	}
+
+	wallets, _ := NewWallets(nodeID)
+	if redeemScriptHex != "" {
+		redeemScript, err := hex.DecodeString(redeemScriptHex)
+		if err != nil {
+			log.Panic(err)
+		}
+		if wallets.AddRedeemScript(redeemScript) != from {
+			log.Panic("ERROR: Redeem script does not match the sender address")
+		}
+	}
+
+	bc := NewBlockchain(nodeID)
+	UTXOSet := UTXOSet{bc}
+	defer bc.db.Close()
+
+	tx := NewUnsignedUTXOTransaction(from, to, amount, lockTime, &UTXOSet)
+	ptx, err := NewPartiallySignedTx(tx, bc, wallets.RedeemScripts)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("%s\n\n", ptx)
+	fmt.Printf("Partially signed transaction: %x\n", ptx.Serialize())
+}
+
+// signRawTx 只用钱包文件和交易里面带的数据签名, 可以在不联网的机器上执行
+func (cli *CLI) signRawTx(ptxHex string, nodeID string) {
+	ptx := decodePartiallySignedTx(ptxHex)
+
+	// 签名之前先把交易内容打印出来, 方便确认
+	fmt.Printf("%s\n\n", ptx)
+
+	wallets, _ := NewWallets(nodeID)
+	fmt.Printf("Added %d signatures, complete: %t\n", ptx.Sign(wallets), ptx.IsComplete())
+	fmt.Printf("Partially signed transaction: %x\n", ptx.Serialize())
+}
+
+// combineRawTx 把多个钱包分别签名的同一个交易合并起来
+func (cli *CLI) combineRawTx(ptxHexes []string) {
+	ptx := decodePartiallySignedTx(ptxHexes[0])
+
+	for _, ptxHex := range ptxHexes[1:] {
+		err := ptx.Combine(decodePartiallySignedTx(ptxHex))
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	fmt.Printf("Complete: %t\n", ptx.IsComplete())
+	fmt.Printf("Partially signed transaction: %x\n", ptx.Serialize())
+}
+
+// sendRawTx 签名完成之后在本地验证, 然后广播出去
+func (cli *CLI) sendRawTx(ptxHex string, nodeID string) {
+	ptx := decodePartiallySignedTx(ptxHex)
+
+	tx, err := ptx.Finalize()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	bc := NewBlockchain(nodeID)
+	defer bc.db.Close()
+
+	if !bc.VerifyTransaction(tx) {
+		log.Panic("ERROR: Invalid transaction")
+	}
+
+	submitTx(nodeID, tx)
+
+	fmt.Printf("Sent transaction %x\n", tx.ID)
+}
+
+func decodePartiallySignedTx(ptxHex string) *PartiallySignedTx {
+	data, err := hex.DecodeString(ptxHex)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	ptx, err := DeserializePartiallySignedTx(data)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return ptx
+}
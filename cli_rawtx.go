@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// rawTxJSON decoderawtransaction -json 的输出格式
+type rawTxJSON struct {
+	Txid     string        `json:"txid"`
+	Size     int           `json:"size"`
+	LockTime uint32        `json:"locktime"`
+	Vin      []rawVinJSON  `json:"vin"`
+	Vout     []rawVoutJSON `json:"vout"`
+}
+
+type rawVinJSON struct {
+	Txid      string `json:"txid"`
+	Vout      int    `json:"vout"`
+	ScriptSig string `json:"scriptSig"`
+	Sequence  uint32 `json:"sequence"`
+}
+
+type rawVoutJSON struct {
+	Value        int      `json:"value"`
+	ScriptPubKey string   `json:"scriptPubKey"`
+	Hex          string   `json:"hex"`
+	Type         string   `json:"type"`
+	Addresses    []string `json:"addresses,omitempty"`
+}
+
+// createRawTransaction 按照指定的输入和输出拼出交易, 不检查金额和输入是否存在, 方便构造各种交易
+// sign为true时用钱包里面的私钥签名
+func (cli *CLI) createRawTransaction(inputs, outputs []string, lockTime uint32, sign bool, nodeID string) {
+	var tx Transaction
+
+	sequence := uint32(MaxSequence)
+	if lockTime != 0 {
+		// 序列号不是最大值, LockTime才会生效
+		sequence = MaxSequence - 1
+	}
+
+	outpoints, err := parseOutpoints(inputs)
+	if err != nil {
+		log.Panic(err)
+	}
+	for _, outpoint := range outpoints {
+		tx.Vin = append(tx.Vin, TXInput{outpoint.Txid, outpoint.Vout, nil, sequence})
+	}
+
+	for _, output := range outputs {
+		parts := strings.Split(output, ":")
+		if len(parts) != 2 {
+			log.Panicf("ERROR: Output %s is not address:amount", output)
+		}
+		if !ValidateAddress(parts[0]) {
+			log.Panicf("ERROR: Address %s is not valid", parts[0])
+		}
+		amount, err := strconv.Atoi(parts[1])
+		if err != nil {
+			log.Panic(err)
+		}
+
+		tx.Vout = append(tx.Vout, *NewTXOutput(amount, parts[0]))
+	}
+
+	tx.LockTime = lockTime
+	tx.ID = tx.Hash()
+
+	if sign {
+		bc := NewBlockchain(nodeID)
+		defer bc.db.Close()
+
+		wallets, _ := NewWallets(nodeID)
+		tx = *wallets.SignTransaction(&tx, bc)
+	}
+
+	fmt.Printf("%x\n", tx.Serialize())
+}
+
+// decodeRawTransaction 打印交易内容, asJSON为true时输出JSON
+func (cli *CLI) decodeRawTransaction(txHex string, asJSON bool) {
+	tx := decodeRawTx(txHex)
+
+	if !asJSON {
+		fmt.Printf("%s\n", tx)
+		return
+	}
+
+	txJSON := rawTxJSON{
+		Txid:     hex.EncodeToString(tx.ID),
+		Size:     len(tx.Serialize()),
+		LockTime: tx.LockTime,
+	}
+	for _, vin := range tx.Vin {
+		txJSON.Vin = append(txJSON.Vin, rawVinJSON{hex.EncodeToString(vin.Txid), vin.Vout, vin.ScriptSig.String(), vin.Sequence})
+	}
+	for _, vout := range tx.Vout {
+		txJSON.Vout = append(txJSON.Vout, rawVoutJSON{
+			vout.Value,
+			vout.ScriptPubKey.String(),
+			hex.EncodeToString(vout.ScriptPubKey),
+			GetScriptClass(vout.ScriptPubKey).String(),
+			ExtractAddresses(vout.ScriptPubKey),
+		})
+	}
+
+	data, err := json.MarshalIndent(txJSON, "", "  ")
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("%s\n", data)
+}
+
+// sendRawTransaction 在本地验证交易之后广播出去, skipCheck为true时不验证, 用于测试其他节点对无效交易的处理
+func (cli *CLI) sendRawTransaction(txHex string, skipCheck bool, nodeID string) {
+	tx := decodeRawTx(txHex)
+
+	if !skipCheck {
+		bc := NewBlockchain(nodeID)
+		_, err := checkMempoolTransaction(&tx, bc)
+		bc.db.Close()
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	submitTx(nodeID, &tx)
+
+	fmt.Printf("Sent transaction %x\n", tx.ID)
+}
+
+// parseOutpoints 解析 txid:vout 格式的输出列表
+func parseOutpoints(items []string) ([]Outpoint, error) {
+	var outpoints []Outpoint
+
+	for _, item := range items {
+		parts := strings.Split(item, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Input %s is not txid:vout", item)
+		}
+		txid, err := hex.DecodeString(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		vout, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		outpoints = append(outpoints, Outpoint{txid, vout})
+	}
+
+	return outpoints, nil
+}
+
+func decodeRawTx(txHex string) Transaction {
+	data, err := hex.DecodeString(txHex)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return DeserializeTransaction(data)
+}
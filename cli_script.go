@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+)
+
+func (cli *CLI) createMultisig(m int, keys []string, nodeID string) {
+	wallets, _ := NewWallets(nodeID)
+
+	var pubKeys [][]byte
+	for _, key := range keys {
+		if wallet, ok := wallets.Wallets[key]; ok {
+			pubKeys = append(pubKeys, wallet.PublicKey)
+			continue
+		}
+
+		pubKey, err := hex.DecodeString(key)
+		if err != nil {
+			log.Panicf("ERROR: %s is neither a public key nor an address in the wallet", key)
+		}
+		pubKeys = append(pubKeys, pubKey)
+	}
+
+	redeemScript, err := MultiSigScript(m, pubKeys)
+	if err != nil {
+		log.Panic(err)
+	}
+	// 赎回脚本在解锁脚本里面是一次压栈的数据, 不能超过单个元素的大小限制
+	if len(redeemScript) > maxScriptElementSize {
+		log.Panic("ERROR: Too many public keys")
+	}
+
+	address := wallets.AddRedeemScript(redeemScript)
+	wallets.SaveToFile(nodeID)
+
+	fmt.Printf("Multisig address: %s\n", address)
+	fmt.Printf("Redeem script: %x\n", []byte(redeemScript))
+	fmt.Printf("asm: %s\n", redeemScript)
+}
+
+// spendMultisig 创建花费多重签名地址的交易, 加上这个钱包的签名之后打印出来, 交给其他共同签名的人
+func (cli *CLI) spendMultisig(from, to string, amount int, redeemScriptHex string, nodeID string) {
+	if !ValidateAddress(from) {
+		log.Panic("ERROR: Sender address is not valid")
+	}
+	if version, _ := DecodeAddress(from); version != scriptHashVersion {
+		log.Panic("ERROR: Sender address is not a multisig address")
+	}
+	if !ValidateAddress(to) {
+		log.Panic("ERROR: Recipient address is not valid")
+	}
+
+	wallets, _ := NewWallets(nodeID)
+	if redeemScriptHex != "" {
+		redeemScript, err := hex.DecodeString(redeemScriptHex)
+		if err != nil {
+			log.Panic(err)
+		}
+		if wallets.AddRedeemScript(redeemScript) != from {
+			log.Panic("ERROR: Redeem script does not match the sender address")
+		}
+	}
+	redeemScript, ok := wallets.RedeemScripts[from]
+	if !ok {
+		log.Panic("ERROR: Redeem script of the sender address is unknown, pass it with -redeemscript")
+	}
+
+	bc := NewBlockchain(nodeID)
+	UTXOSet := UTXOSet{bc}
+	defer bc.db.Close()
+
+	tx := NewUnsignedUTXOTransaction(from, to, amount, 0, &UTXOSet)
+	// 解锁脚本先只放赎回脚本, 每个共同签名的人把自己的签名加进去
+	for inID := range tx.Vin {
+		tx.Vin[inID].ScriptSig = MultiSigSignatureScript(nil, redeemScript)
+	}
+
+	cli.addMultisigSignatures(tx, wallets, nodeID, false)
+}
+
+// signMultisig 给其他人传过来的多重签名交易加上这个钱包的签名, send为true时签名够了就广播出去
+func (cli *CLI) signMultisig(txHex string, nodeID string, send bool) {
+	data, err := hex.DecodeString(txHex)
+	if err != nil {
+		log.Panic(err)
+	}
+	tx := DeserializeTransaction(data)
+
+	wallets, _ := NewWallets(nodeID)
+	cli.addMultisigSignatures(&tx, wallets, nodeID, send)
+}
+
+func (cli *CLI) addMultisigSignatures(tx *Transaction, wallets *Wallets, nodeID string, send bool) {
+	added, missing, err := wallets.SignMultiSig(tx)
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Added %d signatures, %d missing\n", added, missing)
+
+	if missing == 0 && send {
+		submitTx(nodeID, tx)
+		fmt.Println("Success!")
+		return
+	}
+
+	fmt.Printf("Transaction: %x\n", tx.Serialize())
+}
+
+func (cli *CLI) decodeScript(scriptHex string) {
+	data, err := hex.DecodeString(scriptHex)
+	if err != nil {
+		log.Panic(err)
+	}
+	script := Script(data)
+
+	fmt.Printf("asm: %s\n", script)
+	fmt.Printf("type: %s\n", GetScriptClass(script))
+	for _, address := range ExtractAddresses(script) {
+		fmt.Printf("address: %s\n", address)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// sendMany 在一个交易里面转账给多个收款人
+func (cli *CLI) sendMany(from string, recipients []Recipient, opts SendOptions, reuseChange bool, nodeID string, mineNow bool) {
+	seen := make(map[string]bool)
+	for _, recipient := range recipients {
+		if !ValidateAddress(recipient.Address) {
+			log.Panicf("ERROR: Recipient address %s is not valid", recipient.Address)
+		}
+		if seen[recipient.Address] {
+			log.Panicf("ERROR: Duplicated recipient %s", recipient.Address)
+		}
+		seen[recipient.Address] = true
+	}
+
+	tx := cli.submitTransaction(from, recipients, opts, reuseChange, nodeID, mineNow)
+
+	fmt.Printf("Sent %x to %d recipients\n", tx.ID, len(recipients))
+}
+
+// parseRecipients 解析 ADDRESS:AMOUNT,ADDRESS:AMOUNT 格式的收款人列表
+func parseRecipients(list string) ([]Recipient, error) {
+	var recipients []Recipient
+
+	for _, item := range strings.Split(list, ",") {
+		parts := strings.Split(item, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Recipient %s is not address:amount", item)
+		}
+
+		recipient, err := newRecipient(parts[0], parts[1])
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, recipient)
+	}
+
+	return recipients, nil
+}
+
+// loadRecipients 从文件读取收款人列表
+// .json文件是 [{"address": "...", "amount": 10}] 格式的数组, 其他文件按照每行 address,amount 的CSV格式解析, 第一行可以是表头
+func loadRecipients(path string) ([]Recipient, error) {
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var items []struct {
+			Address string `json:"address"`
+			Amount  int    `json:"amount"`
+		}
+		err = json.Unmarshal(data, &items)
+		if err != nil {
+			return nil, err
+		}
+
+		var recipients []Recipient
+		for _, item := range items {
+			recipients = append(recipients, Recipient{item.Address, item.Amount})
+		}
+		return recipients, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var recipients []Recipient
+	for i, record := range records {
+		recipient, err := newRecipient(record[0], record[1])
+		if err != nil {
+			// 第一行的金额不是数字时当作表头
+			if i == 0 {
+				continue
+			}
+			return nil, fmt.Errorf("Line %d: %s", i+1, err)
+		}
+		recipients = append(recipients, recipient)
+	}
+
+	return recipients, nil
+}
+
+func newRecipient(address, amount string) (Recipient, error) {
+	value, err := strconv.Atoi(strings.TrimSpace(amount))
+	if err != nil {
+		return Recipient{}, fmt.Errorf("Invalid amount %s", amount)
+	}
+
+	return Recipient{strings.TrimSpace(address), value}, nil
+}
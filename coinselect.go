@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// bnbMaxTries 分支定界搜索最多尝试的次数, 超过之后放弃精确匹配
+const bnbMaxTries = 100000
+
+// ErrInsufficientFunds 可用的输出不够支付
+var ErrInsufficientFunds = errors.New("Not enough funds")
+
+// Outpoint 指向某个交易的某个输出
+type Outpoint struct {
+	Txid []byte
+	Vout int
+}
+
+// Coin 一个未花费的输出以及它的位置
+type Coin struct {
+	Outpoint
+	Output TXOutput
+}
+
+// CoinSelector 从可用的输出里面选出金额不少于target的一组输出
+type CoinSelector interface {
+	SelectCoins(coins []Coin, target int) ([]Coin, error)
+}
+
+// LargestFirstSelector 优先使用金额大的输出, 输入的数量最少
+type LargestFirstSelector struct{}
+
+// SmallestFirstSelector 优先使用金额小的输出, 可以顺便合并零碎的输出
+type SmallestFirstSelector struct{}
+
+// BranchAndBoundSelector 寻找金额之和在[target, target+CostOfChange]之间的组合, 这样就不需要找零
+// 多出来的部分当作手续费, 找不到的时候退回到LargestFirstSelector
+type BranchAndBoundSelector struct {
+	CostOfChange int
+}
+
+// RandomSelector 随机选择输出, 让别人更难从输入推断出钱包里的其他输出
+type RandomSelector struct{}
+
+// coinSelectors send -coinselect 可以使用的策略
+var coinSelectors = map[string]CoinSelector{
+	"largest":  LargestFirstSelector{},
+	"smallest": SmallestFirstSelector{},
+	"bnb":      BranchAndBoundSelector{DefaultPolicy.CostOfChange()},
+	"random":   RandomSelector{},
+}
+
+// NewCoinSelector 根据名字返回选币策略, 名字为空时使用LargestFirstSelector
+func NewCoinSelector(name string) (CoinSelector, error) {
+	if name == "" {
+		return LargestFirstSelector{}, nil
+	}
+
+	selector, ok := coinSelectors[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown coin selection strategy %s", name)
+	}
+
+	return selector, nil
+}
+
+// SelectCoins 实现CoinSelector
+func (s LargestFirstSelector) SelectCoins(coins []Coin, target int) ([]Coin, error) {
+	sorted := sortCoins(coins, func(a, b Coin) bool { return a.Output.Value > b.Output.Value })
+	return accumulateCoins(sorted, target)
+}
+
+// SelectCoins 实现CoinSelector
+func (s SmallestFirstSelector) SelectCoins(coins []Coin, target int) ([]Coin, error) {
+	sorted := sortCoins(coins, func(a, b Coin) bool { return a.Output.Value < b.Output.Value })
+	return accumulateCoins(sorted, target)
+}
+
+// SelectCoins 实现CoinSelector
+func (s RandomSelector) SelectCoins(coins []Coin, target int) ([]Coin, error) {
+	shuffled := append([]Coin{}, coins...)
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	r.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+
+	return accumulateCoins(shuffled, target)
+}
+
+// SelectCoins 实现CoinSelector
+func (s BranchAndBoundSelector) SelectCoins(coins []Coin, target int) ([]Coin, error) {
+	sorted := sortCoins(coins, func(a, b Coin) bool { return a.Output.Value > b.Output.Value })
+
+	// remaining[i] 是sorted[i:]的金额之和, 用于剪枝
+	remaining := make([]int, len(sorted)+1)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		remaining[i] = remaining[i+1] + sorted[i].Output.Value
+	}
+
+	selected := make([]bool, len(sorted))
+	var best []bool
+	bestExcess := s.CostOfChange + 1
+	tries := 0
+
+	var search func(i, sum int)
+	search = func(i, sum int) {
+		tries++
+		if tries > bnbMaxTries || sum > target+s.CostOfChange {
+			return
+		}
+		if sum >= target {
+			if sum-target < bestExcess {
+				bestExcess = sum - target
+				best = append([]bool{}, selected...)
+			}
+			return
+		}
+		if i == len(sorted) || sum+remaining[i] < target {
+			return
+		}
+
+		selected[i] = true
+		search(i+1, sum+sorted[i].Output.Value)
+		selected[i] = false
+
+		// 金额相同的输出, 前一个没选时后一个也不用再试了
+		j := i + 1
+		for j < len(sorted) && sorted[j].Output.Value == sorted[i].Output.Value {
+			j++
+		}
+		search(j, sum)
+	}
+	search(0, 0)
+
+	if best == nil {
+		return LargestFirstSelector{}.SelectCoins(coins, target)
+	}
+
+	var result []Coin
+	for i, ok := range best {
+		if ok {
+			result = append(result, sorted[i])
+		}
+	}
+
+	return result, nil
+}
+
+// sortCoins 返回排序之后的副本, 不修改coins
+func sortCoins(coins []Coin, less func(a, b Coin) bool) []Coin {
+	sorted := append([]Coin{}, coins...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return less(sorted[i], sorted[j])
+	})
+
+	return sorted
+}
+
+// accumulateCoins 按顺序选择输出, 直到金额足够
+func accumulateCoins(coins []Coin, target int) ([]Coin, error) {
+	var selected []Coin
+	acc := 0
+
+	for _, coin := range coins {
+		if acc >= target {
+			break
+		}
+		selected = append(selected, coin)
+		acc += coin.Output.Value
+	}
+
+	if acc < target {
+		return nil, ErrInsufficientFunds
+	}
+
+	return selected, nil
+}
+
+// sumCoins 返回输出的金额之和
+func sumCoins(coins []Coin) int {
+	sum := 0
+	for _, coin := range coins {
+		sum += coin.Output.Value
+	}
+
+	return sum
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testCoins 为每个金额创建一个输出, 输出的位置用下标区分
+func testCoins(values ...int) []Coin {
+	var coins []Coin
+	for i, value := range values {
+		coins = append(coins, Coin{Outpoint{[]byte("coin"), i}, TXOutput{value, nil}})
+	}
+
+	return coins
+}
+
+func coinValues(coins []Coin) []int {
+	var values []int
+	for _, coin := range coins {
+		values = append(values, coin.Output.Value)
+	}
+
+	return values
+}
+
+func TestCoinSelectors(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector CoinSelector
+		coins    []int
+		target   int
+		want     []int
+		wantErr  error
+	}{
+		{"largest", LargestFirstSelector{}, []int{1, 5, 3, 8}, 10, []int{8, 5}, nil},
+		{"largest exact", LargestFirstSelector{}, []int{1, 5, 3, 8}, 8, []int{8}, nil},
+		{"largest all", LargestFirstSelector{}, []int{1, 5, 3, 8}, 17, []int{8, 5, 3, 1}, nil},
+		{"largest insufficient", LargestFirstSelector{}, []int{1, 5, 3, 8}, 18, nil, ErrInsufficientFunds},
+		{"largest no coins", LargestFirstSelector{}, nil, 1, nil, ErrInsufficientFunds},
+		{"smallest", SmallestFirstSelector{}, []int{1, 5, 3, 8}, 4, []int{1, 3}, nil},
+		{"smallest merges dust", SmallestFirstSelector{}, []int{1, 5, 3, 8}, 6, []int{1, 3, 5}, nil},
+		{"smallest insufficient", SmallestFirstSelector{}, []int{1, 5, 3, 8}, 18, nil, ErrInsufficientFunds},
+		{"bnb exact match", BranchAndBoundSelector{0}, []int{1, 5, 3, 8}, 9, []int{8, 1}, nil},
+		{"bnb skips the largest", BranchAndBoundSelector{0}, []int{10, 6, 4}, 10, []int{10}, nil},
+		{"bnb within cost of change", BranchAndBoundSelector{2}, []int{20, 7, 6}, 12, []int{7, 6}, nil},
+		{"bnb prefers the smallest excess", BranchAndBoundSelector{3}, []int{20, 13, 7, 5}, 12, []int{7, 5}, nil},
+		{"bnb falls back to largest", BranchAndBoundSelector{0}, []int{20, 7, 6}, 12, []int{20}, nil},
+		{"bnb insufficient", BranchAndBoundSelector{5}, []int{1, 5, 3, 8}, 18, nil, ErrInsufficientFunds},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			coins := testCoins(test.coins...)
+			selected, err := test.selector.SelectCoins(coins, test.target)
+			if err != test.wantErr {
+				t.Fatalf("SelectCoins() error = %v, want %v", err, test.wantErr)
+			}
+			if got := coinValues(selected); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("SelectCoins() = %v, want %v", got, test.want)
+			}
+			// 选币不能修改调用者的输出列表
+			if got := coinValues(coins); !reflect.DeepEqual(got, test.coins) {
+				t.Errorf("SelectCoins() reordered the coins to %v", got)
+			}
+		})
+	}
+}
+
+func TestRandomSelector(t *testing.T) {
+	coins := testCoins(1, 5, 3, 8)
+
+	for i := 0; i < 20; i++ {
+		selected, err := RandomSelector{}.SelectCoins(coins, 9)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sumCoins(selected) < 9 {
+			t.Fatalf("SelectCoins() = %v, less than 9", coinValues(selected))
+		}
+		// 去掉最后一个输出之后金额应该不够, 否则选多了
+		if sumCoins(selected[:len(selected)-1]) >= 9 {
+			t.Fatalf("SelectCoins() = %v selected more coins than needed", coinValues(selected))
+		}
+
+		seen := make(map[int]bool)
+		for _, coin := range selected {
+			if seen[coin.Vout] {
+				t.Fatalf("SelectCoins() = %v selected a coin twice", coinValues(selected))
+			}
+			seen[coin.Vout] = true
+		}
+	}
+
+	if _, err := (RandomSelector{}).SelectCoins(coins, 18); err != ErrInsufficientFunds {
+		t.Errorf("SelectCoins() error = %v, want %v", err, ErrInsufficientFunds)
+	}
+}
+
+func TestNewCoinSelector(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    CoinSelector
+		wantErr bool
+	}{
+		{"", LargestFirstSelector{}, false},
+		{"largest", LargestFirstSelector{}, false},
+		{"smallest", SmallestFirstSelector{}, false},
+		{"bnb", BranchAndBoundSelector{DefaultPolicy.CostOfChange()}, false},
+		{"random", RandomSelector{}, false},
+		{"unknown", nil, true},
+	}
+
+	for _, test := range tests {
+		selector, err := NewCoinSelector(test.name)
+		if (err != nil) != test.wantErr {
+			t.Errorf("NewCoinSelector(%q) error = %v, wantErr %v", test.name, err, test.wantErr)
+		}
+		if selector != test.want {
+			t.Errorf("NewCoinSelector(%q) = %#v, want %#v", test.name, selector, test.want)
+		}
+	}
+}
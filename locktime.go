@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+)
+
+const (
+	// MaxSequence 输入默认的序列号, 所有输入都是这个值时交易的LockTime不生效
+	MaxSequence = 0xffffffff
+
+	// lockTimeThreshold LockTime小于这个值表示区块高度, 否则表示unix时间
+	lockTimeThreshold = 500000000
+
+	// 下面是相对时间锁(BIP68)用到的序列号格式
+	// sequenceLockTimeDisableFlag 设置了这个位表示该输入没有相对时间锁
+	sequenceLockTimeDisableFlag = 1 << 31
+	// sequenceLockTimeTypeFlag 设置了这个位表示按时间锁定, 否则按区块数量锁定
+	sequenceLockTimeTypeFlag = 1 << 22
+	// sequenceLockTimeMask 序列号里面表示锁定长度的部分
+	sequenceLockTimeMask = 0x0000ffff
+	// sequenceLockTimeGranularity 按时间锁定时的单位是2^9=512秒
+	sequenceLockTimeGranularity = 9
+)
+
+// SequenceLock 交易的所有相对时间锁合并之后的结果, 交易所在区块的高度和时间都要比它大, -1表示没有限制
+type SequenceLock struct {
+	MinHeight int
+	MinTime   int64
+}
+
+// IsFinal 判断交易在高度为height, 时间(前一个区块的median time past)为blockTime的区块里面是否已经生效
+func (tx *Transaction) IsFinal(height int, blockTime int64) bool {
+	if tx.LockTime == 0 {
+		return true
+	}
+
+	lockTimeLimit := int64(height)
+	if tx.LockTime >= lockTimeThreshold {
+		lockTimeLimit = blockTime
+	}
+
+	if int64(tx.LockTime) < lockTimeLimit {
+		return true
+	}
+
+	// 所有输入的序列号都是最大值时, LockTime不生效
+	for _, vin := range tx.Vin {
+		if vin.Sequence != MaxSequence {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CalcSequenceLock 根据每个输入的序列号和它引用的输出被确认的区块, 计算出交易的相对时间锁
+// pending 是还没有被确认的交易(在同一个区块或者交易池里面), 把它们当作在高度height确认
+func (bc *Blockchain) CalcSequenceLock(tx *Transaction, height int, medianTime int64, pending map[string]bool) (SequenceLock, error) {
+	lock := SequenceLock{-1, -1}
+
+	if tx.IsCoinbase() {
+		return lock, nil
+	}
+
+	for _, vin := range tx.Vin {
+		if vin.Sequence&sequenceLockTimeDisableFlag != 0 {
+			continue
+		}
+
+		coinHeight := height
+		coinTime := medianTime
+		if !pending[hex.EncodeToString(vin.Txid)] {
+			coinBlock, err := bc.FindTransactionBlock(vin.Txid)
+			if err != nil {
+				return lock, err
+			}
+
+			coinHeight = coinBlock.Height
+			coinTime = coinBlock.Timestamp
+			if len(coinBlock.PrevBlockHash) != 0 {
+				coinTime = bc.CalcPastMedianTime(coinBlock.PrevBlockHash)
+			}
+		}
+
+		relativeLock := int64(vin.Sequence & sequenceLockTimeMask)
+		if vin.Sequence&sequenceLockTimeTypeFlag != 0 {
+			minTime := coinTime + relativeLock<<sequenceLockTimeGranularity - 1
+			if minTime > lock.MinTime {
+				lock.MinTime = minTime
+			}
+		} else {
+			minHeight := coinHeight + int(relativeLock) - 1
+			if minHeight > lock.MinHeight {
+				lock.MinHeight = minHeight
+			}
+		}
+	}
+
+	return lock, nil
+}
+
+// CheckTransactionLocks 检查交易的绝对和相对时间锁在高度为height, 时间为medianTime的区块里面是否都已经解锁
+func (bc *Blockchain) CheckTransactionLocks(tx *Transaction, height int, medianTime int64, pending map[string]bool) error {
+	if !tx.IsFinal(height, medianTime) {
+		return fmt.Errorf("Transaction 0x%x is locked until %d", tx.ID, tx.LockTime)
+	}
+
+	lock, err := bc.CalcSequenceLock(tx, height, medianTime, pending)
+	if err != nil {
+		return err
+	}
+
+	if lock.MinHeight >= height || lock.MinTime >= medianTime {
+		return fmt.Errorf("Transaction 0x%x sequence lock is not satisfied", tx.ID)
+	}
+
+	return nil
+}
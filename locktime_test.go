@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// newTestBlockchain 在临时目录里面创建一条链, 第i个区块的时间是timestamps[i], 每个区块只有一个coinbase交易
+// 区块没有工作量证明, 只能用于测试不验证区块的函数
+func newTestBlockchain(t *testing.T, timestamps []int64) (*Blockchain, []*Block) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "blockchain_test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	var blocks []*Block
+	var prevHash []byte
+	for height, timestamp := range timestamps {
+		coinbase := &Transaction{nil, []TXInput{{[]byte{}, -1, Script{byte(height)}, MaxSequence}}, []TXOutput{{subsidy, nil}}, 0}
+		coinbase.ID = coinbase.Hash()
+
+		block := &Block{timestamp, []*Transaction{coinbase}, prevHash, nil, 0, height, nil}
+		hash := sha256.Sum256(append(prevHash, coinbase.ID...))
+		block.Hash = hash[:]
+		blocks = append(blocks, block)
+		prevHash = block.Hash
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte(blocksBucket))
+		if err != nil {
+			return err
+		}
+		for _, block := range blocks {
+			err = b.Put(block.Hash, block.Serialize())
+			if err != nil {
+				return err
+			}
+		}
+
+		return b.Put([]byte("l"), prevHash)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Blockchain{prevHash, db}, blocks
+}
+
+func TestCalcSequenceLock(t *testing.T) {
+	bc, blocks := newTestBlockchain(t, []int64{1000, 1100, 1200, 1300, 1400})
+	// 区块2里面的交易, 它的时间是区块1和区块0的时间的中位数1100
+	coin := blocks[2].Transactions[0].ID
+	coinTime := bc.CalcPastMedianTime(blocks[1].Hash)
+	pendingCoin := []byte("pending")
+	pending := map[string]bool{hex.EncodeToString(pendingCoin): true}
+
+	const height = 10
+	const medianTime = 5000
+
+	tests := []struct {
+		name    string
+		vin     []TXInput
+		want    SequenceLock
+		wantErr bool
+	}{
+		{
+			name: "disabled",
+			vin:  []TXInput{{coin, 0, nil, sequenceLockTimeDisableFlag | 3}},
+			want: SequenceLock{-1, -1},
+		},
+		{
+			name: "max sequence",
+			vin:  []TXInput{{coin, 0, nil, MaxSequence}},
+			want: SequenceLock{-1, -1},
+		},
+		{
+			name: "coinbase",
+			vin:  []TXInput{{[]byte{}, -1, nil, 3}},
+			want: SequenceLock{-1, -1},
+		},
+		{
+			name: "height",
+			vin:  []TXInput{{coin, 0, nil, 3}},
+			want: SequenceLock{2 + 3 - 1, -1},
+		},
+		{
+			name: "zero blocks",
+			vin:  []TXInput{{coin, 0, nil, 0}},
+			want: SequenceLock{2 - 1, -1},
+		},
+		{
+			name: "time",
+			vin:  []TXInput{{coin, 0, nil, sequenceLockTimeTypeFlag | 2}},
+			want: SequenceLock{-1, coinTime + 2<<sequenceLockTimeGranularity - 1},
+		},
+		{
+			name: "bits outside the mask are ignored",
+			vin:  []TXInput{{coin, 0, nil, 1<<16 | 3}},
+			want: SequenceLock{2 + 3 - 1, -1},
+		},
+		{
+			name: "pending height",
+			vin:  []TXInput{{pendingCoin, 0, nil, 3}},
+			want: SequenceLock{height + 3 - 1, -1},
+		},
+		{
+			name: "pending time",
+			vin:  []TXInput{{pendingCoin, 0, nil, sequenceLockTimeTypeFlag | 1}},
+			want: SequenceLock{-1, medianTime + 1<<sequenceLockTimeGranularity - 1},
+		},
+		{
+			name: "largest of several inputs",
+			vin: []TXInput{
+				{coin, 0, nil, 3},
+				{pendingCoin, 0, nil, 1},
+				{coin, 1, nil, sequenceLockTimeTypeFlag | 1},
+				{pendingCoin, 1, nil, sequenceLockTimeTypeFlag | 2},
+			},
+			want: SequenceLock{height + 1 - 1, medianTime + 2<<sequenceLockTimeGranularity - 1},
+		},
+		{
+			name:    "unknown input",
+			vin:     []TXInput{{[]byte("unknown"), 0, nil, 3}},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tx := &Transaction{nil, test.vin, []TXOutput{{1, nil}}, 0}
+
+			lock, err := bc.CalcSequenceLock(tx, height, medianTime, pending)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("CalcSequenceLock() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if err == nil && lock != test.want {
+				t.Errorf("CalcSequenceLock() = %+v, want %+v", lock, test.want)
+			}
+		})
+	}
+}
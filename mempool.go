@@ -0,0 +1,520 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultMaxMempoolBytes 交易池默认最多占用的字节数
+const DefaultMaxMempoolBytes = 5000000
+
+// DefaultMempoolExpiry 交易默认在交易池里面最多停留的时间
+const DefaultMempoolExpiry = 336 * time.Hour
+
+// mempoolIncrementalFee 交易池满了移除交易之后, 最低手续费率在被移除的交易的基础上再提高这么多(每1000字节)
+const mempoolIncrementalFee = 1
+
+// mempoolMinFeeHalfLife 动态最低手续费率每过这么长时间减半
+const mempoolMinFeeHalfLife = 12 * time.Hour
+
+// TxDesc 交易池里面的一个交易, 以及进入交易池时计算好的手续费和大小
+type TxDesc struct {
+	Tx    Transaction
+	Fee   int
+	Size  int
+	Added time.Time
+}
+
+// Mempool 还没有确认的交易, 会被多个处理连接的goroutine同时访问, 所有方法都是并发安全的
+// 交易池里面的交易不会花费同一个输出, spent记录了每个被花费的输出属于哪个交易
+type Mempool struct {
+	mutex sync.RWMutex
+	pool  map[string]*TxDesc
+	// spent 输出(txid:vout) => 花费它的交易id
+	spent map[string]string
+	bytes int
+
+	// maxBytes 超过之后按手续费率从低到高移除交易
+	maxBytes int
+	// expiry 在池里面停留超过这个时间的交易会被移除
+	expiry time.Duration
+	// minFeeRate 交易池满了之后提高的最低手续费率(每1000字节), 从minFeeRateTime开始随时间衰减
+	minFeeRate     int
+	minFeeRateTime time.Time
+}
+
+// MempoolInfo 交易池的统计信息
+type MempoolInfo struct {
+	Count    int
+	Bytes    int
+	MaxBytes int
+	// MinFeeRate 当前进入交易池需要的最低手续费率(每1000字节), 不包括转发规则的MinRelayFee
+	MinFeeRate int
+	Expiry     time.Duration
+	// Oldest 最早进入交易池的交易的时间, 交易池为空时是零值
+	Oldest time.Time
+}
+
+var mempool = NewMempool()
+
+// NewMempool 创建一个空的交易池, 使用默认的大小限制和过期时间
+func NewMempool() *Mempool {
+	return &Mempool{
+		pool:     make(map[string]*TxDesc),
+		spent:    make(map[string]string),
+		maxBytes: DefaultMaxMempoolBytes,
+		expiry:   DefaultMempoolExpiry,
+	}
+}
+
+// SetLimits 修改交易池的大小限制和过期时间, 已经超出的交易在下一次Add或者Expire的时候移除
+func (mp *Mempool) SetLimits(maxBytes int, expiry time.Duration) {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+
+	mp.maxBytes = maxBytes
+	mp.expiry = expiry
+}
+
+// outpointKey 交易池索引里面输出的key
+func outpointKey(txid []byte, vout int) string {
+	return fmt.Sprintf("%x:%d", txid, vout)
+}
+
+// Add 把交易加入交易池, 同时移除replaced里面的交易(replace-by-fee), 和replaced以外的交易冲突时返回错误
+// 交易池超过大小限制时移除手续费率最低的交易; 需要移除tx自己时返回错误, 交易池保持不变
+func (mp *Mempool) Add(tx *Transaction, fee int, replaced []string) error {
+	return mp.addAt(tx, fee, replaced, time.Now())
+}
+
+// addAt 和Add一样, added是交易进入交易池的时间, 从文件恢复交易池时保留原来的时间
+func (mp *Mempool) addAt(tx *Transaction, fee int, replaced []string, added time.Time) error {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+
+	id := hex.EncodeToString(tx.ID)
+	if _, ok := mp.pool[id]; ok {
+		return fmt.Errorf("txn-already-in-mempool: 0x%s", id)
+	}
+
+	err := CheckDuplicateInputs(tx)
+	if err != nil {
+		return err
+	}
+
+	size := len(tx.Serialize())
+	if minFee := (mp.currentMinFeeRate(time.Now())*size + 999) / 1000; fee < minFee {
+		return fmt.Errorf("mempool min fee not met: fee %d is below %d for %d bytes", fee, minFee, size)
+	}
+
+	isReplaced := make(map[string]bool)
+	for _, replacedID := range replaced {
+		isReplaced[replacedID] = true
+	}
+	for _, vin := range tx.Vin {
+		if spender, ok := mp.spent[outpointKey(vin.Txid, vin.Vout)]; ok && !isReplaced[spender] {
+			return fmt.Errorf("txn-mempool-conflict: output %x:%d is already spent by 0x%s", vin.Txid, vin.Vout, spender)
+		}
+	}
+
+	// 交易池满了的时候新交易可能马上被移除, 先在副本上替换、加入和移除一遍, 全部通过之后才修改交易池
+	desc := &TxDesc{*tx, fee, size, added}
+	trial := mp.clone()
+	for _, replacedID := range replaced {
+		trial.removeTx(replacedID)
+	}
+	trial.insertTx(desc)
+	err = trial.trimToSize(id)
+	if err != nil {
+		return err
+	}
+	mp.commit(trial)
+
+	return nil
+}
+
+// clone 复制交易池的索引, 交易描述是共享的, 副本上的修改不会影响mp. 调用者必须持有锁
+func (mp *Mempool) clone() *Mempool {
+	trial := &Mempool{
+		pool:           make(map[string]*TxDesc),
+		spent:          make(map[string]string),
+		bytes:          mp.bytes,
+		maxBytes:       mp.maxBytes,
+		expiry:         mp.expiry,
+		minFeeRate:     mp.minFeeRate,
+		minFeeRateTime: mp.minFeeRateTime,
+	}
+	for id, desc := range mp.pool {
+		trial.pool[id] = desc
+	}
+	for outpoint, spender := range mp.spent {
+		trial.spent[outpoint] = spender
+	}
+
+	return trial
+}
+
+// commit 用副本的交易和最低手续费率替换mp的, 调用者必须持有写锁
+func (mp *Mempool) commit(trial *Mempool) {
+	mp.pool, mp.spent, mp.bytes = trial.pool, trial.spent, trial.bytes
+	mp.minFeeRate, mp.minFeeRateTime = trial.minFeeRate, trial.minFeeRateTime
+}
+
+// insertTx 调用者必须持有写锁, 并且已经检查过desc不和池里面的交易冲突
+func (mp *Mempool) insertTx(desc *TxDesc) {
+	id := hex.EncodeToString(desc.Tx.ID)
+	mp.pool[id] = desc
+	for _, vin := range desc.Tx.Vin {
+		mp.spent[outpointKey(vin.Txid, vin.Vout)] = id
+	}
+	mp.bytes += desc.Size
+}
+
+// trimToSize 交易池超过maxBytes时, 不断移除手续费率最低的交易和它的后代, 并把最低手续费率提高到被移除的交易之上
+// 手续费率取交易自己和它加上所有后代两者中较高的那个, 这样手续费高的子交易可以保护它的父交易
+// 先在副本上移除, 需要移除keep时返回错误, 交易池和最低手续费率都保持不变. 调用者必须持有写锁
+func (mp *Mempool) trimToSize(keep string) error {
+	trial := mp.clone()
+	var evictions []string
+
+	for trial.bytes > trial.maxBytes && len(trial.pool) > 0 {
+		var worst string
+		var worstPkg []string
+		worstFee, worstSize := 0, 1
+
+		for id, desc := range trial.pool {
+			descendants := trial.descendants(id)
+			pkgFee, pkgSize := desc.Fee, desc.Size
+			for _, descendant := range descendants {
+				pkgFee += trial.pool[descendant].Fee
+				pkgSize += trial.pool[descendant].Size
+			}
+
+			fee, size := desc.Fee, desc.Size
+			if pkgFee*size > fee*pkgSize {
+				fee, size = pkgFee, pkgSize
+			}
+
+			lhs, rhs := fee*worstSize, worstFee*size
+			if worst == "" || lhs < rhs || (lhs == rhs && id > worst) {
+				worst = id
+				worstPkg = append(descendants, id)
+				worstFee, worstSize = fee, size
+			}
+		}
+
+		for _, id := range worstPkg {
+			if id == keep {
+				return errors.New("mempool full")
+			}
+			trial.removeTx(id)
+		}
+
+		rate := (worstFee*1000+worstSize-1)/worstSize + mempoolIncrementalFee
+		now := time.Now()
+		if rate > trial.currentMinFeeRate(now) {
+			trial.minFeeRate = rate
+			trial.minFeeRateTime = now
+		}
+		evictions = append(evictions, fmt.Sprintf("Mempool full, evicted 0x%s and %d descendants, min fee rate is %d\n", worst, len(worstPkg)-1, rate))
+	}
+
+	mp.commit(trial)
+	for _, eviction := range evictions {
+		log.Print(eviction)
+	}
+
+	return nil
+}
+
+// currentMinFeeRate 衰减之后的动态最低手续费率, 调用者必须持有锁
+func (mp *Mempool) currentMinFeeRate(now time.Time) int {
+	rate := mp.minFeeRate
+	for elapsed := now.Sub(mp.minFeeRateTime); elapsed >= mempoolMinFeeHalfLife && rate > 0; elapsed -= mempoolMinFeeHalfLife {
+		rate /= 2
+	}
+
+	return rate
+}
+
+// Expire 移除在交易池里面停留超过expiry的交易以及它们的后代, 返回被移除的交易id
+func (mp *Mempool) Expire(now time.Time) []string {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+
+	var expired []string
+	for id, desc := range mp.pool {
+		if now.Sub(desc.Added) <= mp.expiry {
+			continue
+		}
+
+		for _, expiredID := range append(mp.descendants(id), id) {
+			if _, ok := mp.pool[expiredID]; ok {
+				mp.removeTx(expiredID)
+				expired = append(expired, expiredID)
+			}
+		}
+	}
+
+	return expired
+}
+
+// Info 返回交易池的统计信息
+func (mp *Mempool) Info() MempoolInfo {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	info := MempoolInfo{len(mp.pool), mp.bytes, mp.maxBytes, mp.currentMinFeeRate(time.Now()), mp.expiry, time.Time{}}
+	for _, desc := range mp.pool {
+		if info.Oldest.IsZero() || desc.Added.Before(info.Oldest) {
+			info.Oldest = desc.Added
+		}
+	}
+
+	return info
+}
+
+// Remove 从交易池移除交易, 不存在的id会被忽略
+func (mp *Mempool) Remove(ids ...string) {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+
+	for _, id := range ids {
+		mp.removeTx(id)
+	}
+}
+
+// removeTx 调用者必须持有写锁
+func (mp *Mempool) removeTx(id string) {
+	desc, ok := mp.pool[id]
+	if !ok {
+		return
+	}
+
+	for _, vin := range desc.Tx.Vin {
+		delete(mp.spent, outpointKey(vin.Txid, vin.Vout))
+	}
+	mp.bytes -= desc.Size
+	delete(mp.pool, id)
+}
+
+// RemoveBlock 区块连接到链上之后, 移除已经被确认的交易, 以及和区块里面的交易花费同一个输出的交易和它们的后代
+// 返回因为冲突被移除的交易id
+func (mp *Mempool) RemoveBlock(block *Block) []string {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+
+	var conflicts []string
+	for _, tx := range block.Transactions {
+		mp.removeTx(hex.EncodeToString(tx.ID))
+	}
+
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			continue
+		}
+
+		for _, vin := range tx.Vin {
+			spender, ok := mp.spent[outpointKey(vin.Txid, vin.Vout)]
+			if !ok {
+				continue
+			}
+
+			for _, id := range append(mp.descendants(spender), spender) {
+				mp.removeTx(id)
+				conflicts = append(conflicts, id)
+			}
+		}
+	}
+
+	return conflicts
+}
+
+// Get 返回交易池里面的交易
+func (mp *Mempool) Get(id string) (Transaction, bool) {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	desc, ok := mp.pool[id]
+	if !ok {
+		return Transaction{}, false
+	}
+
+	return desc.Tx, true
+}
+
+// GetDesc 返回交易池里面的交易以及它的手续费和大小
+func (mp *Mempool) GetDesc(id string) (TxDesc, bool) {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	desc, ok := mp.pool[id]
+	if !ok {
+		return TxDesc{}, false
+	}
+
+	return *desc, true
+}
+
+// Has 判断交易是否在交易池里面
+func (mp *Mempool) Has(id string) bool {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	_, ok := mp.pool[id]
+	return ok
+}
+
+// Count 交易池里面的交易数量
+func (mp *Mempool) Count() int {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	return len(mp.pool)
+}
+
+// Bytes 交易池里面所有交易序列化之后的字节数之和
+func (mp *Mempool) Bytes() int {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	return mp.bytes
+}
+
+// TxIDs 返回交易池里面所有交易的id, 按id排序
+func (mp *Mempool) TxIDs() []string {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	var ids []string
+	for id := range mp.pool {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// Descs 返回交易池里面所有交易的副本, 按id排序
+func (mp *Mempool) Descs() []TxDesc {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	var descs []TxDesc
+	for _, desc := range mp.pool {
+		descs = append(descs, *desc)
+	}
+	sort.Slice(descs, func(i, j int) bool {
+		return hex.EncodeToString(descs[i].Tx.ID) < hex.EncodeToString(descs[j].Tx.ID)
+	})
+
+	return descs
+}
+
+// Conflicts 返回交易池里面和tx花费了同一个输出的交易id
+func (mp *Mempool) Conflicts(tx *Transaction) []string {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	var conflicts []string
+	seen := make(map[string]bool)
+	for _, vin := range tx.Vin {
+		spender, ok := mp.spent[outpointKey(vin.Txid, vin.Vout)]
+		if ok && !seen[spender] {
+			seen[spender] = true
+			conflicts = append(conflicts, spender)
+		}
+	}
+
+	return conflicts
+}
+
+// PrevTransactions 找到交易的输入引用的所有交易, 可以在交易池里面(还没有确认的父交易)或者链上
+func (mp *Mempool) PrevTransactions(tx *Transaction, bc *Blockchain) (map[string]Transaction, error) {
+	prevTXs := make(map[string]Transaction)
+
+	for _, vin := range tx.Vin {
+		id := hex.EncodeToString(vin.Txid)
+		if prevTX, ok := mp.Get(id); ok {
+			prevTXs[id] = prevTX
+			continue
+		}
+
+		prevTX, err := bc.FindTransaction(vin.Txid)
+		if err != nil {
+			return nil, fmt.Errorf("Input %x:%d: %s", vin.Txid, vin.Vout, err)
+		}
+		prevTXs[id] = prevTX
+	}
+
+	return prevTXs, nil
+}
+
+// Ancestors 返回交易池里面id直接或者间接依赖的交易id, 不包括id本身
+// 这些交易必须先于id确认, 打包时要放在它的前面
+func (mp *Mempool) Ancestors(id string) []string {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	var ancestors []string
+	visited := map[string]bool{id: true}
+	queue := []string{id}
+
+	for len(queue) > 0 {
+		child, ok := mp.pool[queue[0]]
+		queue = queue[1:]
+		if !ok {
+			continue
+		}
+
+		for _, vin := range child.Tx.Vin {
+			parent := hex.EncodeToString(vin.Txid)
+			if _, ok := mp.pool[parent]; ok && !visited[parent] {
+				visited[parent] = true
+				ancestors = append(ancestors, parent)
+				queue = append(queue, parent)
+			}
+		}
+	}
+
+	return ancestors
+}
+
+// Descendants 返回交易池里面直接或者间接花费了id的输出的交易id, 不包括id本身
+func (mp *Mempool) Descendants(id string) []string {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	return mp.descendants(id)
+}
+
+// descendants 通过spent索引查找后代, 调用者必须持有锁
+func (mp *Mempool) descendants(id string) []string {
+	var descendants []string
+	visited := map[string]bool{id: true}
+	queue := []string{id}
+
+	for len(queue) > 0 {
+		parent, ok := mp.pool[queue[0]]
+		queue = queue[1:]
+		if !ok {
+			continue
+		}
+
+		for vout := range parent.Tx.Vout {
+			child, ok := mp.spent[outpointKey(parent.Tx.ID, vout)]
+			if ok && !visited[child] {
+				visited[child] = true
+				descendants = append(descendants, child)
+				queue = append(queue, child)
+			}
+		}
+	}
+
+	return descendants
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// mempoolFile 节点退出时保存交易池的文件
+const mempoolFile = "mempool_%s.dat"
+
+// mempoolSaveInterval 定期保存交易池的间隔, 节点异常退出时最多丢失这么长时间的交易
+const mempoolSaveInterval = 5 * time.Minute
+
+// SaveToFile 把交易池里面的交易保存到文件, 先写临时文件再改名, 保存到一半退出也不会破坏原来的文件
+func (mp *Mempool) SaveToFile(nodeID string) {
+	file := dataFile(mempoolFile, nodeID)
+	var content bytes.Buffer
+
+	encoder := gob.NewEncoder(&content)
+	err := encoder.Encode(mp.Descs())
+	if err != nil {
+		log.Panic(err)
+	}
+
+	err = ioutil.WriteFile(file+".new", content.Bytes(), 0644)
+	if err != nil {
+		log.Panic(err)
+	}
+	err = os.Rename(file+".new", file)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// loadMempool 从文件恢复交易池, 每个交易都按照当前的链和UTXOSet重新验证, 已经确认、花费的输出已经被花掉或者过期的交易被丢弃
+// 返回恢复的交易数量
+func loadMempool(nodeID string, bc *Blockchain) int {
+	file := dataFile(mempoolFile, nodeID)
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return 0
+	}
+
+	fileContent, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var descs []TxDesc
+	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
+	err = decoder.Decode(&descs)
+	if err != nil {
+		log.Printf("Mempool file %s is corrupted, ignored: %s\n", file, err)
+		return 0
+	}
+
+	// 父交易总是比子交易先进入交易池, 按时间恢复就能保证父交易已经在池里面
+	sort.SliceStable(descs, func(i, j int) bool { return descs[i].Added.Before(descs[j].Added) })
+
+	loaded := 0
+	for _, desc := range descs {
+		tx := desc.Tx
+		fee, err := checkMempoolTransaction(&tx, bc)
+		if err == nil {
+			err = mempool.addAt(&tx, fee, nil, desc.Added)
+		}
+		if err != nil {
+			log.Printf("Drop saved tx 0x%s: %s\n", hex.EncodeToString(tx.ID), err)
+			continue
+		}
+		loaded++
+	}
+	expireMempool()
+
+	return loaded
+}
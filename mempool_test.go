@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// mempoolTestTx trimToSize测试里面的一个交易, parent为空时花费一个不在交易池里面的输出
+type mempoolTestTx struct {
+	name   string
+	parent string
+	fee    int
+}
+
+func TestMempoolTrimToSize(t *testing.T) {
+	tests := []struct {
+		name string
+		txs  []mempoolTestTx
+		// limit 交易池的大小限制是这些交易的大小之和
+		limit []string
+		want  []string
+	}{
+		{
+			name:  "under the limit",
+			txs:   []mempoolTestTx{{"a", "", 10}, {"b", "", 20}},
+			limit: []string{"a", "b"},
+			want:  []string{"a", "b"},
+		},
+		{
+			name:  "lowest fee rate first",
+			txs:   []mempoolTestTx{{"a", "", 10}, {"b", "", 30}, {"c", "", 20}},
+			limit: []string{"b", "c"},
+			want:  []string{"b", "c"},
+		},
+		{
+			name:  "several evictions",
+			txs:   []mempoolTestTx{{"a", "", 10}, {"b", "", 30}, {"c", "", 20}},
+			limit: []string{"b"},
+			want:  []string{"b"},
+		},
+		{
+			name:  "descendants are evicted with their parent",
+			txs:   []mempoolTestTx{{"p", "", 5}, {"c", "p", 6}, {"x", "", 20}},
+			limit: []string{"x", "c"},
+			want:  []string{"x"},
+		},
+		{
+			name:  "child pays for parent",
+			txs:   []mempoolTestTx{{"p", "", 1}, {"c", "p", 40}, {"x", "", 10}},
+			limit: []string{"p", "c"},
+			want:  []string{"p", "c"},
+		},
+		{
+			name:  "low fee child is evicted alone",
+			txs:   []mempoolTestTx{{"p", "", 30}, {"c", "p", 1}, {"x", "", 10}},
+			limit: []string{"p", "x"},
+			want:  []string{"p", "x"},
+		},
+		{
+			name:  "everything",
+			txs:   []mempoolTestTx{{"a", "", 10}, {"b", "", 30}},
+			limit: nil,
+			want:  nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mp := NewMempool()
+			txs := make(map[string]*Transaction)
+
+			for _, ttx := range test.txs {
+				input := TXInput{[]byte("prev-" + ttx.name), 0, nil, MaxSequence}
+				if ttx.parent != "" {
+					input = TXInput{txs[ttx.parent].ID, 0, nil, MaxSequence}
+				}
+				tx := testTx(1, input)
+				txs[ttx.name] = tx
+
+				err := mp.Add(tx, ttx.fee, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			limit := 0
+			for _, name := range test.limit {
+				limit += len(txs[name].Serialize())
+			}
+			mp.mutex.Lock()
+			mp.maxBytes = limit
+			err := mp.trimToSize("")
+			mp.mutex.Unlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := make(map[string]bool)
+			for _, name := range test.want {
+				want[name] = true
+			}
+			for name, tx := range txs {
+				if has := mp.Has(hex.EncodeToString(tx.ID)); has != want[name] {
+					t.Errorf("%s in mempool = %v, want %v", name, has, want[name])
+				}
+			}
+			if mp.Bytes() > limit {
+				t.Errorf("mempool has %d bytes, limit is %d", mp.Bytes(), limit)
+			}
+		})
+	}
+}
+
+func TestMempoolTrimRaisesMinFee(t *testing.T) {
+	mp := NewMempool()
+	cheap := testTx(1, TXInput{[]byte("prev-1"), 0, nil, MaxSequence})
+	size := len(cheap.Serialize())
+	mp.SetLimits(size, DefaultMempoolExpiry)
+
+	if err := mp.Add(cheap, 10, nil); err != nil {
+		t.Fatal(err)
+	}
+	// 加入之后超过了限制, 手续费率更低的cheap被移除
+	better := testTx(1, TXInput{[]byte("prev-2"), 0, nil, MaxSequence})
+	if err := mp.Add(better, 20, nil); err != nil {
+		t.Fatal(err)
+	}
+	if mp.Has(hex.EncodeToString(cheap.ID)) {
+		t.Fatal("cheap transaction was not evicted")
+	}
+
+	wantRate := (10*1000+size-1)/size + mempoolIncrementalFee
+	if info := mp.Info(); info.MinFeeRate != wantRate {
+		t.Errorf("MinFeeRate = %d, want %d", info.MinFeeRate, wantRate)
+	}
+
+	// 手续费率不高于被移除的交易时不能再进入交易池
+	again := testTx(1, TXInput{[]byte("prev-3"), 0, nil, MaxSequence})
+	err := mp.Add(again, 10, nil)
+	if err == nil || !strings.Contains(err.Error(), "mempool min fee not met") {
+		t.Errorf("Add() error = %v, want mempool min fee not met", err)
+	}
+}
+
+func TestMempoolAddEvictsItself(t *testing.T) {
+	mp := NewMempool()
+	better := testTx(1, TXInput{[]byte("prev-1"), 0, nil, MaxSequence})
+	size := len(better.Serialize())
+	mp.SetLimits(size, DefaultMempoolExpiry)
+
+	if err := mp.Add(better, 20, nil); err != nil {
+		t.Fatal(err)
+	}
+	before := mp.Info()
+
+	// 加入之后超过了限制, 手续费率最低的是新交易自己, 交易池和最低手续费率都不能改变
+	cheap := testTx(1, TXInput{[]byte("prev-2"), 0, nil, MaxSequence})
+	err := mp.Add(cheap, 10, nil)
+	if err == nil || !strings.Contains(err.Error(), "mempool full") {
+		t.Fatalf("Add() error = %v, want mempool full", err)
+	}
+
+	if mp.Has(hex.EncodeToString(cheap.ID)) || !mp.Has(hex.EncodeToString(better.ID)) {
+		t.Errorf("mempool = %v, want only 0x%x", mp.TxIDs(), better.ID)
+	}
+	if info := mp.Info(); info.Bytes != before.Bytes || info.MinFeeRate != before.MinFeeRate {
+		t.Errorf("Info() = %+v, want %+v", info, before)
+	}
+	if conflicts := mp.Conflicts(cheap); len(conflicts) != 0 {
+		t.Errorf("Conflicts() = %v, want none", conflicts)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// messageHeaderLength 消息头的长度: 网络标识(4) + 命令(commandLength) + payload长度(4) + 校验和(4)
+const messageHeaderLength = 4 + commandLength + 4 + 4
+
+// 连接上的每条消息都是 消息头 + payload, 整数都是小端序
+// 一个连接上可以连续发送多条消息, 读的时候根据消息头里面的长度切分
+
+// messageChecksum payload两次sha256之后的前4个字节
+func messageChecksum(payload []byte) []byte {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+
+	return second[:4]
+}
+
+// WriteMessage 把一条消息写到w
+func WriteMessage(w io.Writer, command string, payload []byte) error {
+	if len(command) > commandLength {
+		return fmt.Errorf("Command %s is longer than %d bytes", command, commandLength)
+	}
+
+	var header bytes.Buffer
+	binary.Write(&header, binary.LittleEndian, activeNetParams.Net)
+	header.Write(commandToBytes(command))
+	binary.Write(&header, binary.LittleEndian, uint32(len(payload)))
+	header.Write(messageChecksum(payload))
+
+	_, err := w.Write(append(header.Bytes(), payload...))
+	return err
+}
+
+// ReadMessage 从r读取一条完整的消息. 网络标识不对、payload超过maxMessageSize或者校验和不对时返回错误,
+// 这时连接上后面的数据已经无法切分, 调用者应该断开连接. 消息读到一半连接就断开时返回io.ErrUnexpectedEOF
+func ReadMessage(r io.Reader) (string, []byte, error) {
+	header := make([]byte, messageHeaderLength)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return "", nil, err
+	}
+
+	magic := binary.LittleEndian.Uint32(header[:4])
+	if magic != activeNetParams.Net {
+		return "", nil, fmt.Errorf("Message is from network 0x%08x, expected 0x%08x", magic, activeNetParams.Net)
+	}
+
+	command := bytesToCommand(header[4 : 4+commandLength])
+	length := binary.LittleEndian.Uint32(header[4+commandLength:])
+	if int64(length) > int64(maxMessageSize()) {
+		return "", nil, fmt.Errorf("Message %s has %d bytes, more than %d", command, length, maxMessageSize())
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	checksum := header[4+commandLength+4:]
+	if !bytes.Equal(checksum, messageChecksum(payload)) {
+		return "", nil, fmt.Errorf("Message %s has a bad checksum", command)
+	}
+
+	return command, payload, nil
+}
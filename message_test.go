@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+)
+
+// testMessage 返回WriteMessage写出的一条完整消息
+func testMessage(t *testing.T, command string, payload []byte) []byte {
+	var buff bytes.Buffer
+	err := WriteMessage(&buff, command, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buff.Bytes()
+}
+
+func TestReadMessage(t *testing.T) {
+	payload := []byte("payload")
+	valid := testMessage(t, "tx", payload)
+
+	// modify 返回修改过的valid的副本
+	modify := func(f func(msg []byte) []byte) []byte {
+		return f(append([]byte{}, valid...))
+	}
+
+	tests := []struct {
+		name        string
+		data        []byte
+		wantCommand string
+		wantPayload []byte
+		// wantErr 为空时不应该出错
+		wantErr    string
+		wantErrVal error
+	}{
+		{
+			name:        "valid",
+			data:        valid,
+			wantCommand: "tx",
+			wantPayload: payload,
+		},
+		{
+			name:        "empty payload",
+			data:        testMessage(t, "verack", []byte{}),
+			wantCommand: "verack",
+			wantPayload: []byte{},
+		},
+		{
+			name:       "no data",
+			data:       nil,
+			wantErrVal: io.EOF,
+		},
+		{
+			name:       "truncated header",
+			data:       valid[:messageHeaderLength-1],
+			wantErrVal: io.ErrUnexpectedEOF,
+		},
+		{
+			name:       "missing payload",
+			data:       valid[:messageHeaderLength],
+			wantErrVal: io.ErrUnexpectedEOF,
+		},
+		{
+			name:       "truncated payload",
+			data:       valid[:len(valid)-1],
+			wantErrVal: io.ErrUnexpectedEOF,
+		},
+		{
+			name: "bad magic",
+			data: modify(func(msg []byte) []byte {
+				msg[0] ^= 0xff
+				return msg
+			}),
+			wantErr: "is from network",
+		},
+		{
+			name: "oversize",
+			data: modify(func(msg []byte) []byte {
+				binary.LittleEndian.PutUint32(msg[4+commandLength:], uint32(maxMessageSize()+1))
+				return msg
+			}),
+			wantErr: "more than",
+		},
+		{
+			name: "huge length",
+			data: modify(func(msg []byte) []byte {
+				binary.LittleEndian.PutUint32(msg[4+commandLength:], 0xffffffff)
+				return msg
+			}),
+			wantErr: "more than",
+		},
+		{
+			name: "bad checksum",
+			data: modify(func(msg []byte) []byte {
+				msg[4+commandLength+4] ^= 0xff
+				return msg
+			}),
+			wantErr: "bad checksum",
+		},
+		{
+			name: "corrupted payload",
+			data: modify(func(msg []byte) []byte {
+				msg[len(msg)-1] ^= 0xff
+				return msg
+			}),
+			wantErr: "bad checksum",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			command, data, err := ReadMessage(bytes.NewReader(test.data))
+
+			switch {
+			case test.wantErrVal != nil:
+				if err != test.wantErrVal {
+					t.Fatalf("ReadMessage() error = %v, want %v", err, test.wantErrVal)
+				}
+			case test.wantErr != "":
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("ReadMessage() error = %v, want %s", err, test.wantErr)
+				}
+			default:
+				if err != nil {
+					t.Fatal(err)
+				}
+				if command != test.wantCommand || !bytes.Equal(data, test.wantPayload) {
+					t.Errorf("ReadMessage() = %s %q, want %s %q", command, data, test.wantCommand, test.wantPayload)
+				}
+			}
+		})
+	}
+}
+
+func TestReadMessageStream(t *testing.T) {
+	stream := append(testMessage(t, "version", []byte("first")), testMessage(t, "verack", nil)...)
+	r := bytes.NewReader(stream)
+
+	for _, want := range []string{"version", "verack"} {
+		command, _, err := ReadMessage(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if command != want {
+			t.Errorf("ReadMessage() command = %s, want %s", command, want)
+		}
+	}
+	if _, _, err := ReadMessage(r); err != io.EOF {
+		t.Errorf("ReadMessage() at the end error = %v, want %v", err, io.EOF)
+	}
+}
+
+func TestWriteMessageLongCommand(t *testing.T) {
+	var buff bytes.Buffer
+	err := WriteMessage(&buff, strings.Repeat("x", commandLength+1), nil)
+	if err == nil {
+		t.Error("WriteMessage() accepted a command longer than commandLength")
+	}
+}
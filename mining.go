@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/hex"
+	"sort"
+)
+
+// blockReserveSize 给区块头和gob编码的类型信息预留的字节数
+const blockReserveSize = 1000
+
+// templateEntry 打包时候选交易的信息, parents是它依赖的、同样在候选里面的交易
+type templateEntry struct {
+	tx      *Transaction
+	fee     int
+	size    int
+	parents []string
+}
+
+// NewBlockTemplate 从候选交易里面挑出能放进一个区块的交易, coinbase放在最前面
+// fees是交易id(hex) => 手续费, 选中的交易的手续费都付给minerAddress
+// 候选交易可以花费其他候选交易的输出. 每次选择祖先手续费率(交易和它还没有选中的祖先一起计算)最高的交易,
+// 连同祖先一起放进区块, 父交易总是在子交易前面. 这样手续费高的子交易可以带上手续费低的父交易(child-pays-for-parent)
+func NewBlockTemplate(candidates []*Transaction, fees map[string]int, minerAddress string) []*Transaction {
+	entries := make(map[string]*templateEntry)
+	for _, tx := range candidates {
+		id := hex.EncodeToString(tx.ID)
+		entries[id] = &templateEntry{tx, fees[id], len(tx.Serialize()), nil}
+	}
+	for _, entry := range entries {
+		seen := make(map[string]bool)
+		for _, vin := range entry.tx.Vin {
+			id := hex.EncodeToString(vin.Txid)
+			if _, ok := entries[id]; ok && !seen[id] {
+				seen[id] = true
+				entry.parents = append(entry.parents, id)
+			}
+		}
+	}
+
+	var txs []*Transaction
+	// 手续费只会让coinbase多几个字节, 已经包含在blockReserveSize里面
+	size := blockReserveSize + len(NewCoinbaseTX(minerAddress, "").Serialize())
+	totalFees := 0
+	selected := make(map[string]bool)
+	// failed 放不下的交易, 不再尝试
+	failed := make(map[string]bool)
+
+	for {
+		var best []string
+		bestFee, bestSize := 0, 1
+		for id := range entries {
+			if selected[id] || failed[id] {
+				continue
+			}
+
+			pkg := templateAncestors(id, entries, selected)
+			pkgFee, pkgSize := 0, 0
+			for _, pkgID := range pkg {
+				pkgFee += entries[pkgID].fee
+				pkgSize += entries[pkgID].size
+			}
+
+			// 比较手续费率 pkgFee/pkgSize 和 bestFee/bestSize, 相同时按id排序, 让结果是确定的
+			lhs, rhs := pkgFee*bestSize, bestFee*pkgSize
+			if best == nil || lhs > rhs || (lhs == rhs && id < best[len(best)-1]) {
+				best = pkg
+				bestFee, bestSize = pkgFee, pkgSize
+			}
+		}
+		if best == nil {
+			break
+		}
+
+		if size+bestSize > activeNetParams.MaxBlockSize {
+			// 放不下的交易留在池里面, 依赖它的交易也一样
+			failed[best[len(best)-1]] = true
+			continue
+		}
+
+		for _, id := range best {
+			selected[id] = true
+			txs = append(txs, entries[id].tx)
+		}
+		size += bestSize
+		totalFees += bestFee
+	}
+
+	return append([]*Transaction{NewCoinbaseTXWithFees(minerAddress, "", totalFees)}, txs...)
+}
+
+// templateAncestors 返回id和它所有还没有选中的祖先, 按依赖顺序排列, id在最后
+func templateAncestors(id string, entries map[string]*templateEntry, selected map[string]bool) []string {
+	visited := make(map[string]bool)
+	var pkg []string
+
+	var visit func(id string)
+	visit = func(id string) {
+		if visited[id] || selected[id] {
+			return
+		}
+		visited[id] = true
+
+		parents := append([]string{}, entries[id].parents...)
+		sort.Strings(parents)
+		for _, parent := range parents {
+			visit(parent)
+		}
+		pkg = append(pkg, id)
+	}
+	visit(id)
+
+	return pkg
+}
+
+// withAncestors 去掉在交易池里面有祖先不在candidates里面的交易, 这样的交易现在还不能打包
+func withAncestors(candidates []*Transaction, fees map[string]int) []*Transaction {
+	var result []*Transaction
+
+	for _, tx := range candidates {
+		ready := true
+		for _, id := range mempool.Ancestors(hex.EncodeToString(tx.ID)) {
+			if _, ok := fees[id]; !ok {
+				ready = false
+				break
+			}
+		}
+
+		if ready {
+			result = append(result, tx)
+		}
+	}
+
+	return result
+}
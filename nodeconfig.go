@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// nodeConfigFile 节点的配置文件, 不存在时只使用命令行参数
+const nodeConfigFile = "node_%s.conf"
+
+// NodeConfig 节点监听的地址, 告诉其他节点的地址, 以及启动时主动连接哪些节点
+type NodeConfig struct {
+	// Listen 监听的主机名或者IP, 例如 127.0.0.2, 这样一台机器上可以用不同的回环地址运行多个节点
+	Listen string
+	// Port 监听的端口
+	Port string
+	// ExternalIP 在version里面告诉其他节点的地址, 可以带端口, 不带时使用Port. 为空时使用Listen
+	ExternalIP string
+	// Connect 不为空时只连接这些节点, 不会连接从其他节点学到的地址
+	Connect []string
+	// AddNode 启动时连接这些节点, 断开之后会重新连接
+	AddNode []string
+}
+
+// ListenAddress 监听的地址
+func (c NodeConfig) ListenAddress() string {
+	return net.JoinHostPort(c.Listen, c.Port)
+}
+
+// ExternalAddress 其他节点连接本节点使用的地址, 也就是消息里面的AddrFrom
+func (c NodeConfig) ExternalAddress() string {
+	host := c.ExternalIP
+	if host == "" {
+		host = c.Listen
+	}
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	// 监听所有地址时没有一个确定的地址可以告诉其他节点, 只能用本机地址
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+
+	return net.JoinHostPort(host, c.Port)
+}
+
+// LoadNodeConfig 读取配置文件, 每行是 KEY=VALUE, #开头的行是注释. KEY可以是
+// listen, port, externalip, connect, addnode, 后两个可以出现多次. 文件不存在时返回空的配置
+func LoadNodeConfig(path string) (NodeConfig, error) {
+	var config NodeConfig
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return config, fmt.Errorf("%s:%d: expected KEY=VALUE, got %q", path, lineNum, line)
+		}
+		value := strings.TrimSpace(parts[1])
+
+		switch strings.TrimSpace(parts[0]) {
+		case "listen":
+			config.Listen = value
+		case "port":
+			config.Port = value
+		case "externalip":
+			config.ExternalIP = value
+		case "connect":
+			config.Connect = append(config.Connect, value)
+		case "addnode":
+			config.AddNode = append(config.AddNode, value)
+		default:
+			return config, fmt.Errorf("%s:%d: unknown option %s", path, lineNum, parts[0])
+		}
+	}
+
+	return config, scanner.Err()
+}
+
+// parseNodeList 解析逗号分隔的节点地址
+func parseNodeList(list string) []string {
+	var nodes []string
+	for _, node := range strings.Split(list, ",") {
+		if node = strings.TrimSpace(node); node != "" {
+			nodes = append(nodes, node)
+		}
+	}
+
+	return nodes
+}
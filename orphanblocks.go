@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// maxOrphanBlocks 最多保存多少个父块还没有到达的区块, 满了之后随机移除一个
+const maxOrphanBlocks = 100
+
+// maxOrphanBlocksPerPeer 每个节点最多可以在孤儿区块池里面放多少个区块, 防止一个节点占满整个池
+const maxOrphanBlocksPerPeer = 20
+
+// orphanBlockExpiry 孤儿区块等待父块的最长时间
+const orphanBlockExpiry = 20 * time.Minute
+
+// orphanBlock 一个父块还不在本地的区块, 以及发送它的节点
+type orphanBlock struct {
+	Block   *Block
+	From    *Peer
+	Expires time.Time
+}
+
+// OrphanBlockPool 同步时提前到达的区块, 按父块hash索引, 父块连接到链上之后再按顺序连接它们
+// 所有方法都是并发安全的
+type OrphanBlockPool struct {
+	mutex  sync.Mutex
+	blocks map[string]*orphanBlock
+	// byParent 父块hash => 等待它的区块hash
+	byParent map[string]map[string]bool
+}
+
+var orphanBlocks = NewOrphanBlockPool()
+
+// NewOrphanBlockPool 创建一个空的孤儿区块池
+func NewOrphanBlockPool() *OrphanBlockPool {
+	return &OrphanBlockPool{blocks: make(map[string]*orphanBlock), byParent: make(map[string]map[string]bool)}
+}
+
+// Add 保存一个孤儿区块, from是发送它的节点. from的孤儿区块太多时返回错误
+// 调用者必须先检查区块的工作量证明, 否则伪造的区块可以随意占用池, 甚至让父块指向自己
+func (op *OrphanBlockPool) Add(block *Block, from *Peer) error {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+
+	hash := hex.EncodeToString(block.Hash)
+	if _, ok := op.blocks[hash]; ok {
+		return nil
+	}
+
+	op.expire(time.Now())
+
+	// 按IP计数, 重新连接换一个端口不能得到新的额度
+	fromCount := 0
+	for _, orphan := range op.blocks {
+		if orphan.From.Host() == from.Host() {
+			fromCount++
+		}
+	}
+	if fromCount >= maxOrphanBlocksPerPeer {
+		return fmt.Errorf("too-many-orphans: %s already has %d orphan blocks", from.Host(), fromCount)
+	}
+
+	// map的遍历顺序是随机的, 第一个就是随机选中的区块
+	for evictHash := range op.blocks {
+		if len(op.blocks) < maxOrphanBlocks {
+			break
+		}
+		op.remove(evictHash)
+	}
+
+	parent := hex.EncodeToString(block.PrevBlockHash)
+	op.blocks[hash] = &orphanBlock{block, from, time.Now().Add(orphanBlockExpiry)}
+	if op.byParent[parent] == nil {
+		op.byParent[parent] = make(map[string]bool)
+	}
+	op.byParent[parent][hash] = true
+
+	return nil
+}
+
+// Has 判断区块是否在孤儿区块池里面
+func (op *OrphanBlockPool) Has(hash []byte) bool {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+
+	_, ok := op.blocks[hex.EncodeToString(hash)]
+	return ok
+}
+
+// Get 返回池里面的区块
+func (op *OrphanBlockPool) Get(hash []byte) (*Block, bool) {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+
+	orphan, ok := op.blocks[hex.EncodeToString(hash)]
+	if !ok {
+		return nil, false
+	}
+	return orphan.Block, true
+}
+
+// MissingAncestor 沿着孤儿区块的父块一直往前找, 返回第一个不在池里面的祖先的hash, 这就是需要向其他节点请求的区块
+// 父块链上出现环的时候返回nil, 没有可以请求的区块
+func (op *OrphanBlockPool) MissingAncestor(hash []byte) []byte {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+
+	visited := make(map[string]bool)
+	for {
+		key := hex.EncodeToString(hash)
+		orphan, ok := op.blocks[key]
+		if !ok {
+			return hash
+		}
+		if visited[key] {
+			return nil
+		}
+		visited[key] = true
+		hash = orphan.Block.PrevBlockHash
+	}
+}
+
+// TakeChildren 从池里取出所有父块是parentHash的孤儿区块
+func (op *OrphanBlockPool) TakeChildren(parentHash []byte) []orphanBlock {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+
+	var children []orphanBlock
+	for hash := range op.byParent[hex.EncodeToString(parentHash)] {
+		children = append(children, *op.blocks[hash])
+		op.remove(hash)
+	}
+
+	return children
+}
+
+// expire 移除等待太久的孤儿区块, 调用者必须持有锁
+func (op *OrphanBlockPool) expire(now time.Time) {
+	for hash, orphan := range op.blocks {
+		if now.After(orphan.Expires) {
+			op.remove(hash)
+		}
+	}
+}
+
+// remove 调用者必须持有锁
+func (op *OrphanBlockPool) remove(hash string) {
+	orphan, ok := op.blocks[hash]
+	if !ok {
+		return
+	}
+
+	parent := hex.EncodeToString(orphan.Block.PrevBlockHash)
+	delete(op.byParent[parent], hash)
+	if len(op.byParent[parent]) == 0 {
+		delete(op.byParent, parent)
+	}
+	delete(op.blocks, hash)
+}
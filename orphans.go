@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// maxOrphanTransactions 孤儿交易池最多保存的交易数量, 满了之后随机移除一个
+const maxOrphanTransactions = 100
+
+// maxOrphansPerPeer 每个节点最多可以在孤儿交易池里面放多少个交易, 防止一个节点占满整个池
+const maxOrphansPerPeer = 20
+
+// orphanExpiry 孤儿交易等待父交易的最长时间
+const orphanExpiry = 20 * time.Minute
+
+// orphanTx 一个还缺少父交易的交易, 以及发送它的连接. 缺少的父交易也是从这个连接请求的
+type orphanTx struct {
+	Tx      Transaction
+	From    *Peer
+	Expires time.Time
+}
+
+// OrphanPool 输入引用了未知交易的交易, 等父交易到达之后再重新处理. 所有方法都是并发安全的
+type OrphanPool struct {
+	mutex   sync.Mutex
+	orphans map[string]*orphanTx
+	// byParent 父交易id => 等待它的孤儿交易id
+	byParent map[string]map[string]bool
+}
+
+var orphanPool = NewOrphanPool()
+
+// NewOrphanPool 创建一个空的孤儿交易池
+func NewOrphanPool() *OrphanPool {
+	return &OrphanPool{orphans: make(map[string]*orphanTx), byParent: make(map[string]map[string]bool)}
+}
+
+// Add 把孤儿交易加入池里, from是发送它的连接. 交易太大或者from的孤儿交易太多时返回错误
+// 按连接的IP计数, 不能用消息里面对方自己填写的地址, 也不能带上端口, 否则改一下地址或者重新连接就可以绕过限制
+func (op *OrphanPool) Add(tx *Transaction, from *Peer) error {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+
+	id := hex.EncodeToString(tx.ID)
+	if _, ok := op.orphans[id]; ok {
+		return nil
+	}
+
+	// 孤儿交易还没有验证过, 只接受不超过标准大小的交易
+	if size := len(tx.Serialize()); size > activePolicy.MaxStandardTxSize {
+		return fmt.Errorf("orphan-tx-size: %d bytes exceeds %d", size, activePolicy.MaxStandardTxSize)
+	}
+
+	op.expire(time.Now())
+
+	fromCount := 0
+	for _, orphan := range op.orphans {
+		if orphan.From.Host() == from.Host() {
+			fromCount++
+		}
+	}
+	if fromCount >= maxOrphansPerPeer {
+		return fmt.Errorf("too-many-orphans: %s already has %d orphan transactions", from.Host(), fromCount)
+	}
+
+	// map的遍历顺序是随机的, 第一个就是随机选中的交易
+	for evictID := range op.orphans {
+		if len(op.orphans) < maxOrphanTransactions {
+			break
+		}
+		op.remove(evictID)
+	}
+
+	op.orphans[id] = &orphanTx{*tx, from, time.Now().Add(orphanExpiry)}
+	for _, vin := range tx.Vin {
+		parent := hex.EncodeToString(vin.Txid)
+		if op.byParent[parent] == nil {
+			op.byParent[parent] = make(map[string]bool)
+		}
+		op.byParent[parent][id] = true
+	}
+
+	return nil
+}
+
+// Has 判断交易是否在孤儿交易池里面
+func (op *OrphanPool) Has(id string) bool {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+
+	_, ok := op.orphans[id]
+	return ok
+}
+
+// Count 孤儿交易的数量
+func (op *OrphanPool) Count() int {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+
+	return len(op.orphans)
+}
+
+// TakeChildren 从池里取出所有花费parentID的输出的孤儿交易, 以及发送它们的节点
+// 取出来的交易由调用者重新处理, 仍然缺少父交易时再放回来
+func (op *OrphanPool) TakeChildren(parentID string) []orphanTx {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+
+	var children []orphanTx
+	for id := range op.byParent[parentID] {
+		if orphan, ok := op.orphans[id]; ok {
+			children = append(children, *orphan)
+			op.remove(id)
+		}
+	}
+
+	return children
+}
+
+// Expire 移除等待太久的孤儿交易, 返回移除的数量
+func (op *OrphanPool) Expire(now time.Time) int {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+
+	return op.expire(now)
+}
+
+// RemovePeer 连接断开之后移除它发送的孤儿交易, 缺少的父交易是向它请求的, 不会再到达了. 返回移除的数量
+func (op *OrphanPool) RemovePeer(peer *Peer) int {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+
+	removed := 0
+	for id, orphan := range op.orphans {
+		if orphan.From == peer {
+			op.remove(id)
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// expire 调用者必须持有锁
+func (op *OrphanPool) expire(now time.Time) int {
+	expired := 0
+	for id, orphan := range op.orphans {
+		if now.After(orphan.Expires) {
+			op.remove(id)
+			expired++
+		}
+	}
+
+	return expired
+}
+
+// remove 调用者必须持有锁
+func (op *OrphanPool) remove(id string) {
+	orphan, ok := op.orphans[id]
+	if !ok {
+		return
+	}
+
+	for _, vin := range orphan.Tx.Vin {
+		parent := hex.EncodeToString(vin.Txid)
+		delete(op.byParent[parent], id)
+		if len(op.byParent[parent]) == 0 {
+			delete(op.byParent, parent)
+		}
+	}
+	delete(op.orphans, id)
+}
+
+// missingParents 返回tx的输入引用的、既不在交易池也不在链上的交易id
+func missingParents(tx *Transaction, bc *Blockchain) [][]byte {
+	var missing [][]byte
+	seen := make(map[string]bool)
+
+	for _, vin := range tx.Vin {
+		id := hex.EncodeToString(vin.Txid)
+		if seen[id] || mempool.Has(id) {
+			continue
+		}
+		seen[id] = true
+
+		if _, err := bc.FindTransaction(vin.Txid); err != nil {
+			missing = append(missing, vin.Txid)
+		}
+	}
+
+	return missing
+}
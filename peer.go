@@ -0,0 +1,483 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxOutboundPeers 最多同时主动连接多少个节点
+const maxOutboundPeers = 8
+
+// maxInboundPeers 最多同时接受多少个其他节点的连接, 超过之后新的连接直接关闭
+const maxInboundPeers = 32
+
+// sendQueueSize 每个节点的发送队列长度, 队列满了说明对方接收太慢, 直接断开
+const sendQueueSize = 100
+
+// dialTimeout 主动连接最多等待多久
+const dialTimeout = 10 * time.Second
+
+// handshakeTimeout 连接建立之后对方必须在这个时间内发送version
+const handshakeTimeout = time.Minute
+
+// maxKnownInventory 每个连接最多记住多少个对方已经有的交易和区块, 超过之后忘记最早的
+const maxKnownInventory = 1000
+
+// nodeNetwork version里面的服务标志: 保存完整的链并转发交易和区块. 命令行发送交易时不设置这个标志
+const nodeNetwork uint64 = 1
+
+var errOutboundFull = errors.New("no free outbound connection slot")
+
+// dialLocalIP 节点监听在一个回环地址上时, 连接其他本机节点也从这个地址发起.
+// 一台机器上用127.0.0.2、127.0.0.3这样不同的回环地址运行多个节点时, 对方看到的连接地址才能区分出是哪个节点
+var dialLocalIP net.IP
+
+// outMessage 发送队列里面的一条消息
+type outMessage struct {
+	command string
+	payload []byte
+}
+
+// Peer 和另一个节点之间的一个长连接, 两个方向都可以连续发送多条消息
+// 发送的消息先进入队列, 由writeLoop按顺序写到连接上, 所以一个慢的节点不会阻塞其他节点
+type Peer struct {
+	// addr 主动连接时是对方的监听地址, 被连接时是连接的远端地址
+	addr    string
+	conn    net.Conn
+	inbound bool
+
+	sendQueue chan outMessage
+	quit      chan struct{}
+	closeOnce sync.Once
+
+	// 下面的字段由mutex保护
+	mutex sync.Mutex
+	// 握手时从对方的version消息得到的信息
+	versionReceived bool
+	verackReceived  bool
+	listenAddr      string
+	version         int
+	bestHeight      int
+	services        uint64
+	// 流量统计
+	connTime  time.Time
+	lastSend  time.Time
+	lastRecv  time.Time
+	bytesSent uint64
+	bytesRecv uint64
+	msgsSent  uint64
+	msgsRecv  uint64
+	// knownInventory 对方已经有的交易和区块, 转发时跳过它们. knownOrder 按加入的顺序, 用于忘记最早的
+	knownInventory map[string]bool
+	knownOrder     []string
+
+	// blocksInTransit 同步时还要向这个节点依次请求的区块, 由chainMutex保护
+	blocksInTransit [][]byte
+}
+
+// PeerInfo getpeerinfo返回的一个节点的状态
+type PeerInfo struct {
+	Addr          string
+	ListenAddr    string
+	Inbound       bool
+	HandshakeDone bool
+	Version       int
+	BestHeight    int
+	Services      uint64
+	ConnTime      time.Time
+	LastSend      time.Time
+	LastRecv      time.Time
+	BytesSent     uint64
+	BytesRecv     uint64
+	MsgsSent      uint64
+	MsgsRecv      uint64
+}
+
+func newPeer(addr string, conn net.Conn, inbound bool) *Peer {
+	return &Peer{
+		addr:      addr,
+		conn:      conn,
+		inbound:   inbound,
+		sendQueue: make(chan outMessage, sendQueueSize),
+		quit:      make(chan struct{}),
+		connTime:  time.Now(),
+
+		knownInventory: make(map[string]bool),
+	}
+}
+
+// Addr 返回节点地址
+func (p *Peer) Addr() string {
+	return p.addr
+}
+
+// Host 返回节点地址里面的IP. 对方重新连接时端口会变, 按节点限制资源时要用IP
+func (p *Peer) Host() string {
+	host, _, err := net.SplitHostPort(p.addr)
+	if err != nil {
+		return p.addr
+	}
+	return host
+}
+
+// ListenAddr 返回对方在version里面告诉我们的监听地址, 还没有收到version时为空
+func (p *Peer) ListenAddr() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.listenAddr
+}
+
+// VersionReceived 是否已经收到对方的version
+func (p *Peer) VersionReceived() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.versionReceived
+}
+
+// Send 把一条消息放进发送队列. 连接已经断开或者队列已满时返回错误, 队列满时同时断开连接
+func (p *Peer) Send(command string, payload []byte) error {
+	select {
+	case <-p.quit:
+		return fmt.Errorf("peer %s is disconnected", p.addr)
+	default:
+	}
+
+	select {
+	case p.sendQueue <- outMessage{command, payload}:
+		return nil
+	default:
+		peers.Remove(p)
+		return fmt.Errorf("send queue of %s is full, disconnected", p.addr)
+	}
+}
+
+// Close 关闭连接, 正在运行的readLoop和writeLoop会随之退出
+func (p *Peer) Close() {
+	p.closeOnce.Do(func() {
+		close(p.quit)
+		p.conn.Close()
+	})
+}
+
+// writeLoop 按顺序把发送队列里面的消息写到连接上, 写失败时断开连接
+func (p *Peer) writeLoop() {
+	for {
+		select {
+		case msg := <-p.sendQueue:
+			err := WriteMessage(p.conn, msg.command, msg.payload)
+			if err != nil {
+				log.Printf("Send %s to %s failed: %s\n", msg.command, p.addr, err)
+				peers.Remove(p)
+				return
+			}
+
+			p.mutex.Lock()
+			p.lastSend = time.Now()
+			p.bytesSent += uint64(messageHeaderLength + len(msg.payload))
+			p.msgsSent++
+			p.mutex.Unlock()
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// readLoop 不断读取消息并交给handleMessage处理, 同一个连接上的消息按顺序处理
+// 连接断开或者收到无法切分的消息时关闭连接, 并从peers里面移除
+func (p *Peer) readLoop(bc *Blockchain) {
+	defer peers.Remove(p)
+
+	// 握手完成之前对方必须尽快发送version, 防止空闲的连接一直占用位置
+	p.conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+
+	for {
+		command, payload, err := ReadMessage(p.conn)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			// 处理消息的时候已经断开了连接, 断开的原因已经记录过了
+			select {
+			case <-p.quit:
+			default:
+				log.Printf("Disconnect %s: %s\n", p.addr, err)
+			}
+			return
+		}
+
+		p.mutex.Lock()
+		p.lastRecv = time.Now()
+		p.bytesRecv += uint64(messageHeaderLength + len(payload))
+		p.msgsRecv++
+		p.mutex.Unlock()
+
+		handleMessage(p, command, payload, bc)
+	}
+}
+
+// recordVersion 记录对方的version, 返回false表示这个连接上已经收到过version
+func (p *Peer) recordVersion(payload verzion) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.versionReceived {
+		return false
+	}
+
+	p.versionReceived = true
+	p.listenAddr = payload.AddrFrom
+	p.version = payload.Version
+	p.bestHeight = payload.BestHeight
+	p.services = payload.Services
+	p.conn.SetReadDeadline(time.Time{})
+
+	return true
+}
+
+// IsNode 对方是否是一个转发交易和区块的节点, 命令行发送交易的连接不是
+func (p *Peer) IsNode() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.versionReceived && p.services&nodeNetwork != 0
+}
+
+// AddKnownInventory 记录对方已经有了这个交易或者区块: 对方发给我们的, 或者我们已经通知过对方的
+func (p *Peer) AddKnownInventory(id []byte) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	key := hex.EncodeToString(id)
+	if p.knownInventory[key] {
+		return
+	}
+
+	if len(p.knownOrder) >= maxKnownInventory {
+		delete(p.knownInventory, p.knownOrder[0])
+		p.knownOrder = p.knownOrder[1:]
+	}
+	p.knownInventory[key] = true
+	p.knownOrder = append(p.knownOrder, key)
+}
+
+// HasInventory 对方是否已经有了这个交易或者区块
+func (p *Peer) HasInventory(id []byte) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.knownInventory[hex.EncodeToString(id)]
+}
+
+// recordVerack 对方确认了我们的version, 握手完成
+func (p *Peer) recordVerack() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.verackReceived = true
+}
+
+// Info 返回节点当前的状态
+func (p *Peer) Info() PeerInfo {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return PeerInfo{
+		Addr:          p.addr,
+		ListenAddr:    p.listenAddr,
+		Inbound:       p.inbound,
+		HandshakeDone: p.versionReceived && p.verackReceived,
+		Version:       p.version,
+		BestHeight:    p.bestHeight,
+		Services:      p.services,
+		ConnTime:      p.connTime,
+		LastSend:      p.lastSend,
+		LastRecv:      p.lastRecv,
+		BytesSent:     p.bytesSent,
+		BytesRecv:     p.bytesRecv,
+		MsgsSent:      p.msgsSent,
+		MsgsRecv:      p.msgsRecv,
+	}
+}
+
+// PeerManager 管理当前打开的所有连接. 主动连接和被动连接各有固定数量的位置,
+// 主动连接按对方的监听地址索引, 发消息时复用; 被动连接完成握手之后也可以按对方的监听地址找到
+type PeerManager struct {
+	mutex    sync.Mutex
+	outbound map[string]*Peer
+	inbound  map[*Peer]bool
+	// bc 节点运行时才有, 这时主动连接也会读取对方发过来的消息
+	bc *Blockchain
+}
+
+var peers = NewPeerManager()
+
+// NewPeerManager 创建一个没有任何连接的PeerManager
+func NewPeerManager() *PeerManager {
+	return &PeerManager{outbound: make(map[string]*Peer), inbound: make(map[*Peer]bool)}
+}
+
+// Connect 返回到addr的连接, 还没有连接时先建立连接并发送version
+func (pm *PeerManager) Connect(addr string) (*Peer, error) {
+	if addr == "" || addr == nodeAddress {
+		return nil, fmt.Errorf("can not connect to %q", addr)
+	}
+
+	if peer, err := pm.find(addr); peer != nil || err != nil {
+		return peer, err
+	}
+
+	// 连接可能要等很久, 不能一直持有锁
+	conn, err := dial(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	// 等待连接的时候其他goroutine可能已经连上了
+	if peer, err := pm.findLocked(addr); peer != nil || err != nil {
+		conn.Close()
+		return peer, err
+	}
+
+	peer := newPeer(addr, conn, false)
+	pm.outbound[addr] = peer
+	go peer.writeLoop()
+	go peer.readLoop(pm.bc)
+	sendVersion(peer, pm.bc)
+
+	return peer, nil
+}
+
+// dial 建立到addr的连接. 设置了dialLocalIP并且addr是回环地址时, 从dialLocalIP发起连接
+func dial(addr string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: dialTimeout}
+
+	if host, _, err := net.SplitHostPort(addr); err == nil && dialLocalIP != nil {
+		if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+			dialer.LocalAddr = &net.TCPAddr{IP: dialLocalIP}
+		}
+	}
+
+	return dialer.Dial(protocol, addr)
+}
+
+// find 返回已经打开的到addr的连接, 没有连接并且主动连接的位置已满时返回errOutboundFull
+func (pm *PeerManager) find(addr string) (*Peer, error) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	return pm.findLocked(addr)
+}
+
+// findLocked 调用者必须持有锁
+func (pm *PeerManager) findLocked(addr string) (*Peer, error) {
+	if peer, ok := pm.outbound[addr]; ok {
+		return peer, nil
+	}
+	// 对方已经连接过来并且告诉了我们它的监听地址, 直接用这个连接
+	for peer := range pm.inbound {
+		if peer.ListenAddr() == addr {
+			return peer, nil
+		}
+	}
+
+	if len(pm.outbound) >= maxOutboundPeers {
+		return nil, errOutboundFull
+	}
+
+	return nil, nil
+}
+
+// Accept 记录一个被动接受的连接, 开始读取消息. 被动连接的位置已满时直接关闭连接
+func (pm *PeerManager) Accept(conn net.Conn) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	if len(pm.inbound) >= maxInboundPeers {
+		log.Printf("Inbound slots are full, refuse %s\n", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	peer := newPeer(conn.RemoteAddr().String(), conn, true)
+	pm.inbound[peer] = true
+
+	go peer.writeLoop()
+	go peer.readLoop(pm.bc)
+}
+
+// Remove 关闭连接并移除
+func (pm *PeerManager) Remove(peer *Peer) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	peer.Close()
+	if pm.outbound[peer.addr] == peer {
+		delete(pm.outbound, peer.addr)
+	}
+	delete(pm.inbound, peer)
+
+	if removed := orphanPool.RemovePeer(peer); removed > 0 {
+		log.Printf("Removed %d orphan transactions from %s\n", removed, peer.addr)
+	}
+}
+
+// Connected 是否已经有到addr的连接, 包括对方连接过来并且告诉了我们它的监听地址的
+func (pm *PeerManager) Connected(addr string) bool {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	peer, _ := pm.findLocked(addr)
+	return peer != nil
+}
+
+// OutboundCount 主动连接的数量
+func (pm *PeerManager) OutboundCount() int {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	return len(pm.outbound)
+}
+
+// Peers 返回当前所有连接
+func (pm *PeerManager) Peers() []*Peer {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	var all []*Peer
+	for _, peer := range pm.outbound {
+		all = append(all, peer)
+	}
+	for peer := range pm.inbound {
+		all = append(all, peer)
+	}
+
+	return all
+}
+
+// Info 返回除了exclude之外所有连接的状态, 按连接时间排序. exclude是发起查询的连接
+func (pm *PeerManager) Info(exclude *Peer) []PeerInfo {
+	infos := []PeerInfo{}
+	for _, peer := range pm.Peers() {
+		if peer != exclude {
+			infos = append(infos, peer.Info())
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ConnTime.Before(infos[j].ConnTime)
+	})
+
+	return infos
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxStandardScriptSigSize 标准交易里面解锁脚本的最大字节数, 足够放下15个公钥的多重签名
+const maxStandardScriptSigSize = 1650
+
+// changeOutputSize 估算的一个P2PKH找零输出的字节数
+const changeOutputSize = 40
+
+// changeInputSize 估算的以后花费找零输出的输入的字节数, 包括签名和公钥
+const changeInputSize = 180
+
+// Policy 节点转发和打包交易时使用的规则, 和共识规则不同, 每个节点可以有自己的设置
+// 不满足Policy的交易不会进入交易池, 但是如果已经在区块里面, 区块仍然是有效的
+type Policy struct {
+	// DustThreshold 金额小于它的输出(OP_RETURN除外)是粉尘, 不转发
+	DustThreshold int
+	// MaxStandardTxSize 序列化之后交易的最大字节数
+	MaxStandardTxSize int
+	// MinRelayFee 每1000字节最少要付的手续费
+	MinRelayFee int
+	// StandardOutputTypes 允许的输出类型
+	StandardOutputTypes map[ScriptClass]bool
+}
+
+// DefaultPolicy 默认的转发规则
+var DefaultPolicy = Policy{
+	DustThreshold:     1,
+	MaxStandardTxSize: 50000,
+	MinRelayFee:       0,
+	StandardOutputTypes: map[ScriptClass]bool{
+		PubKeyHashTy: true,
+		ScriptHashTy: true,
+		MultiSigTy:   true,
+		NullDataTy:   true,
+	},
+}
+
+// activePolicy 当前节点使用的转发规则, 可以通过startnode的参数修改
+var activePolicy = DefaultPolicy
+
+// ParseOutputTypes 解析逗号分隔的输出类型名字, 例如 pubkeyhash,scripthash
+func ParseOutputTypes(names string) (map[ScriptClass]bool, error) {
+	types := make(map[ScriptClass]bool)
+
+	for _, name := range strings.Split(names, ",") {
+		found := false
+		for class, className := range scriptClassNames {
+			if class != NonStandardTy && className == name {
+				types[class] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Unknown output type %s", name)
+		}
+	}
+
+	return types, nil
+}
+
+// CostOfChange 产生一个找零输出的成本: 找零至少要达到粉尘的金额, 还要付现在增加这个输出以及以后花费它的手续费.
+// 选出的输入多出来的金额不超过它时, 不找零而是作为手续费更合算, 见BranchAndBoundSelector
+func (p *Policy) CostOfChange() int {
+	return p.DustThreshold + p.MinFee(changeOutputSize) + p.MinFee(changeInputSize)
+}
+
+// MinFee 大小为size字节的交易最少要付的手续费
+func (p *Policy) MinFee(size int) int {
+	return (p.MinRelayFee*size + 999) / 1000
+}
+
+// CheckTransactionStandard 检查交易是否满足转发规则, fee是交易的手续费
+func (p *Policy) CheckTransactionStandard(tx *Transaction, fee int) error {
+	size := len(tx.Serialize())
+	if size > p.MaxStandardTxSize {
+		return fmt.Errorf("tx-size: %d bytes exceeds %d", size, p.MaxStandardTxSize)
+	}
+
+	for i, vin := range tx.Vin {
+		if len(vin.ScriptSig) > maxStandardScriptSigSize {
+			return fmt.Errorf("scriptsig-size: input %d has %d bytes", i, len(vin.ScriptSig))
+		}
+		if !vin.ScriptSig.IsPushOnly() {
+			return fmt.Errorf("scriptsig-not-pushonly: input %d", i)
+		}
+	}
+
+	err := CheckDataCarrier(tx)
+	if err != nil {
+		return err
+	}
+
+	dataOutputs := 0
+	for i, out := range tx.Vout {
+		class := GetScriptClass(out.ScriptPubKey)
+		if !p.StandardOutputTypes[class] {
+			return fmt.Errorf("scriptpubkey: output %d is %s", i, class)
+		}
+
+		if class == NullDataTy {
+			dataOutputs++
+			continue
+		}
+		if out.Value < p.DustThreshold {
+			return fmt.Errorf("dust: output %d value %d is below %d", i, out.Value, p.DustThreshold)
+		}
+	}
+	if dataOutputs > 1 {
+		return fmt.Errorf("multi-op-return: %d data outputs", dataOutputs)
+	}
+
+	if minFee := p.MinFee(size); fee < minFee {
+		return fmt.Errorf("min-relay-fee: fee %d is below %d for %d bytes", fee, minFee, size)
+	}
+
+	return nil
+}
+
+// CheckDataCarrier 检查OP_RETURN输出携带的数据没有超过MaxDataCarrierSize, 这是转发交易的规则, 不检查区块
+func CheckDataCarrier(tx *Transaction) error {
+	for i, out := range tx.Vout {
+		if !out.ScriptPubKey.IsUnspendable() {
+			continue
+		}
+
+		data, ok := ExtractNullData(out.ScriptPubKey)
+		if !ok {
+			return fmt.Errorf("Transaction 0x%x output %d is not a valid data carrier", tx.ID, i)
+		}
+		if len(data) > activeNetParams.MaxDataCarrierSize {
+			return fmt.Errorf("Transaction 0x%x output %d carries %d bytes, the limit is %d", tx.ID, i, len(data), activeNetParams.MaxDataCarrierSize)
+		}
+	}
+
+	return nil
+}
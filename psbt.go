@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// PartiallySignedTx 还没有签名完成的交易, 加上签名需要用到的数据
+// 可以在多个钱包之间传递, 每个钱包加上自己的签名, 签名够了之后再生成最终的交易
+type PartiallySignedTx struct {
+	Tx     Transaction
+	Inputs []PartialInput
+}
+
+// PartialInput 一个输入签名需要的数据和已经收集到的签名
+type PartialInput struct {
+	// PrevOut 输入引用的输出, 签名的时候需要它的锁定脚本
+	PrevOut TXOutput
+	// RedeemScript P2SH输出的赎回脚本
+	RedeemScript Script
+	// Signatures 公钥(hex) => 签名
+	Signatures map[string][]byte
+}
+
+// NewPartiallySignedTx 为未签名的交易找到每个输入引用的输出, redeemScripts用于查找P2SH输出的赎回脚本
+func NewPartiallySignedTx(tx *Transaction, bc *Blockchain, redeemScripts map[string]Script) (*PartiallySignedTx, error) {
+	ptx := PartiallySignedTx{Tx: tx.TrimmedCopy()}
+
+	for _, vin := range tx.Vin {
+		prevTx, err := bc.FindTransaction(vin.Txid)
+		if err != nil {
+			return nil, err
+		}
+		if vin.Vout < 0 || vin.Vout >= len(prevTx.Vout) {
+			return nil, fmt.Errorf("Output %x:%d is not found", vin.Txid, vin.Vout)
+		}
+
+		input := PartialInput{PrevOut: prevTx.Vout[vin.Vout], Signatures: make(map[string][]byte)}
+		if GetScriptClass(input.PrevOut.ScriptPubKey) == ScriptHashTy {
+			address := ExtractAddresses(input.PrevOut.ScriptPubKey)[0]
+			redeemScript, ok := redeemScripts[address]
+			if !ok {
+				return nil, fmt.Errorf("Redeem script of %s is not found", address)
+			}
+			input.RedeemScript = redeemScript
+		}
+
+		ptx.Inputs = append(ptx.Inputs, input)
+	}
+
+	return &ptx, nil
+}
+
+// Sign 用wallets里面的私钥对所有能签名的输入签名, 返回新增的签名数量
+func (ptx *PartiallySignedTx) Sign(wallets *Wallets) int {
+	count := 0
+
+	for inID, input := range ptx.Inputs {
+		subScript, pubKeys := input.signingKeys()
+
+		for _, pubKey := range pubKeys {
+			if _, ok := input.Signatures[hex.EncodeToString(pubKey)]; ok {
+				continue
+			}
+
+			wallet := wallets.GetWalletByPubKey(pubKey)
+			if wallet == nil {
+				continue
+			}
+
+			input.Signatures[hex.EncodeToString(pubKey)] = ptx.Tx.SignInput(wallet.PrivateKey, inID, subScript)
+			count++
+		}
+
+		// P2PKH的输出只有公钥哈希, 需要找到对应的钱包
+		if pubKeys == nil && GetScriptClass(input.PrevOut.ScriptPubKey) == PubKeyHashTy && len(input.Signatures) == 0 {
+			address := ExtractAddresses(input.PrevOut.ScriptPubKey)[0]
+			if wallet, ok := wallets.Wallets[address]; ok {
+				input.Signatures[hex.EncodeToString(wallet.PublicKey)] = ptx.Tx.SignInput(wallet.PrivateKey, inID, subScript)
+				count++
+			}
+		}
+	}
+
+	return count
+}
+
+// signingKeys 返回签名用到的脚本和可以签名的公钥, P2PKH的公钥在签名之前是不知道的, 返回nil
+func (input *PartialInput) signingKeys() (Script, [][]byte) {
+	if input.RedeemScript != nil {
+		_, pubKeys, _ := ExtractMultiSig(input.RedeemScript)
+		return input.RedeemScript, pubKeys
+	}
+
+	return input.PrevOut.ScriptPubKey, nil
+}
+
+// IsComplete 每个输入是否都收集到了足够的签名
+func (ptx *PartiallySignedTx) IsComplete() bool {
+	for _, input := range ptx.Inputs {
+		if _, err := input.signatureScript(); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// signatureScript 用收集到的签名生成解锁脚本
+func (input *PartialInput) signatureScript() (Script, error) {
+	switch GetScriptClass(input.PrevOut.ScriptPubKey) {
+	case PubKeyHashTy:
+		for pubKeyHex, sig := range input.Signatures {
+			pubKey, _ := hex.DecodeString(pubKeyHex)
+			return SignatureScript(sig, pubKey), nil
+		}
+		return nil, errors.New("Missing signature")
+
+	case ScriptHashTy:
+		m, pubKeys, ok := ExtractMultiSig(input.RedeemScript)
+		if !ok {
+			return nil, errors.New("Redeem script is not multisig")
+		}
+
+		// 签名的顺序必须和赎回脚本里面公钥的顺序一致
+		var sigs [][]byte
+		for _, pubKey := range pubKeys {
+			if sig, ok := input.Signatures[hex.EncodeToString(pubKey)]; ok && len(sigs) < m {
+				sigs = append(sigs, sig)
+			}
+		}
+		if len(sigs) < m {
+			return nil, fmt.Errorf("Need %d signatures, got %d", m, len(sigs))
+		}
+		return MultiSigSignatureScript(sigs, input.RedeemScript), nil
+	}
+
+	return nil, errors.New("Unsupported output script")
+}
+
+// Finalize 签名够了之后生成可以广播的交易
+func (ptx *PartiallySignedTx) Finalize() (*Transaction, error) {
+	tx := ptx.Tx.TrimmedCopy()
+
+	for inID := range ptx.Inputs {
+		scriptSig, err := ptx.Inputs[inID].signatureScript()
+		if err != nil {
+			return nil, fmt.Errorf("Input %d: %s", inID, err)
+		}
+		tx.Vin[inID].ScriptSig = scriptSig
+	}
+
+	return &tx, nil
+}
+
+// Combine 把other里面的签名合并进来, 两者必须是同一个交易
+func (ptx *PartiallySignedTx) Combine(other *PartiallySignedTx) error {
+	if fmt.Sprintf("%x", ptx.Tx.TrimmedCopy()) != fmt.Sprintf("%x", other.Tx.TrimmedCopy()) {
+		return errors.New("Partially signed transactions are not for the same transaction")
+	}
+
+	for inID, input := range other.Inputs {
+		if ptx.Inputs[inID].RedeemScript == nil {
+			ptx.Inputs[inID].RedeemScript = input.RedeemScript
+		}
+
+		for pubKey, sig := range input.Signatures {
+			ptx.Inputs[inID].Signatures[pubKey] = sig
+		}
+	}
+
+	return nil
+}
+
+// String 返回交易内容以及每个输入引用的输出和签名数量, 签名之前方便确认
+func (ptx PartiallySignedTx) String() string {
+	var lines []string
+
+	lines = append(lines, fmt.Sprintf("%s", ptx.Tx))
+	for inID, input := range ptx.Inputs {
+		lines = append(lines, fmt.Sprintf("     Input %d spends:", inID))
+		lines = append(lines, fmt.Sprintf("       Value:  %d", input.PrevOut.Value))
+		lines = append(lines, fmt.Sprintf("       ScriptPubKey: %s", input.PrevOut.ScriptPubKey))
+		if input.RedeemScript != nil {
+			lines = append(lines, fmt.Sprintf("       RedeemScript: %s", input.RedeemScript))
+		}
+		lines = append(lines, fmt.Sprintf("       Signatures: %d", len(input.Signatures)))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Serialize 序列化PartiallySignedTx
+func (ptx *PartiallySignedTx) Serialize() []byte {
+	var buff bytes.Buffer
+
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(ptx)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return buff.Bytes()
+}
+
+// DeserializePartiallySignedTx 反序列化PartiallySignedTx
+func DeserializePartiallySignedTx(data []byte) (*PartiallySignedTx, error) {
+	var ptx PartiallySignedTx
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&ptx)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ptx.Inputs) != len(ptx.Tx.Vin) {
+		return nil, errors.New("Inputs do not match the transaction")
+	}
+	for i := range ptx.Inputs {
+		if ptx.Inputs[i].Signatures == nil {
+			ptx.Inputs[i].Signatures = make(map[string][]byte)
+		}
+	}
+
+	return &ptx, nil
+}
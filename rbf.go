@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// MaxRBFSequence 有输入的序列号不大于它时, 表示交易在确认之前可以被替换(BIP125)
+const MaxRBFSequence = 0xfffffffd
+
+// maxReplacementEvictions 一次替换最多可以从交易池里面移除的交易数量
+const maxReplacementEvictions = 100
+
+// SignalsReplacement 交易是否允许被手续费更高的交易替换
+func (tx *Transaction) SignalsReplacement() bool {
+	for _, vin := range tx.Vin {
+		if vin.Sequence <= MaxRBFSequence {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkReplacement 检查tx能否替换交易池里面和它冲突的交易, fee是tx的手续费
+// 返回需要从交易池移除的交易id(冲突的交易以及它们的后代), 没有冲突时返回nil
+func checkReplacement(tx *Transaction, fee int) ([]string, error) {
+	conflicts := mempool.Conflicts(tx)
+	if len(conflicts) == 0 {
+		return nil, nil
+	}
+
+	size := len(tx.Serialize())
+	evicted := make(map[string]bool)
+	for _, id := range conflicts {
+		conflict, ok := mempool.GetDesc(id)
+		if !ok {
+			continue
+		}
+		if !conflict.Tx.SignalsReplacement() {
+			return nil, fmt.Errorf("txn-mempool-conflict: spends the same output as 0x%s", id)
+		}
+
+		// 手续费率必须比每一个被替换的交易都高, fee/size > conflict.Fee/conflict.Size
+		if fee*conflict.Size <= conflict.Fee*size {
+			return nil, fmt.Errorf("insufficient fee: fee rate is not higher than 0x%s", id)
+		}
+
+		evicted[id] = true
+		for _, descendant := range mempool.Descendants(id) {
+			evicted[descendant] = true
+		}
+	}
+
+	if len(evicted) > maxReplacementEvictions {
+		return nil, fmt.Errorf("too many potential replacements: %d", len(evicted))
+	}
+
+	var ids []string
+	evictedFees := 0
+	for id := range evicted {
+		for _, vin := range tx.Vin {
+			if hex.EncodeToString(vin.Txid) == id {
+				return nil, errors.New("bad-txns-spends-conflicting-tx")
+			}
+		}
+
+		if evicted, ok := mempool.GetDesc(id); ok {
+			evictedFees += evicted.Fee
+			ids = append(ids, id)
+		}
+	}
+
+	// 新交易除了补上被替换交易的手续费, 还要为自己的大小付转发的手续费
+	if fee <= evictedFees || fee-evictedFees < activePolicy.MinFee(size) {
+		return nil, fmt.Errorf("insufficient fee: %d does not pay for the %d replaced", fee, evictedFees)
+	}
+
+	return ids, nil
+}
+
+// NewFeeBumpTransaction 用同样的输入和收款人创建wtx的替换交易, 手续费提高到newFee, 多出来的手续费从找零里面扣除
+// 扣除之后找零低于粉尘限制时直接去掉找零. 返回的交易还没有签名
+func NewFeeBumpTransaction(wtx WalletTx, newFee int) (*WalletTx, error) {
+	if !wtx.Tx.SignalsReplacement() {
+		return nil, errors.New("Transaction is not replaceable")
+	}
+	if newFee <= wtx.Fee {
+		return nil, fmt.Errorf("New fee %d must be higher than %d", newFee, wtx.Fee)
+	}
+	if wtx.ChangeIndex < 0 {
+		return nil, errors.New("Transaction has no change output to pay the fee")
+	}
+
+	bumped := WalletTx{wtx.Tx.TrimmedCopy(), newFee, wtx.ChangeIndex}
+	change := bumped.Tx.Vout[wtx.ChangeIndex].Value - (newFee - wtx.Fee)
+	if change < 0 {
+		return nil, fmt.Errorf("Change %d is not enough for fee %d", bumped.Tx.Vout[wtx.ChangeIndex].Value, newFee)
+	}
+
+	if change < DefaultPolicy.DustThreshold {
+		bumped.Fee += change
+		bumped.Tx.Vout = append(bumped.Tx.Vout[:wtx.ChangeIndex], bumped.Tx.Vout[wtx.ChangeIndex+1:]...)
+		bumped.ChangeIndex = -1
+	} else {
+		bumped.Tx.Vout[wtx.ChangeIndex].Value = change
+	}
+	bumped.Tx.ID = bumped.Tx.Hash()
+
+	return &bumped, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/hex"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testTx 创建一个付给固定地址的交易, 每个输出金额为1, 没有签名
+func testTx(outputs int, inputs ...TXInput) *Transaction {
+	var vout []TXOutput
+	for i := 0; i < outputs; i++ {
+		vout = append(vout, TXOutput{1, PayToPubKeyHashScript(make([]byte, 20))})
+	}
+
+	tx := &Transaction{nil, inputs, vout, 0}
+	tx.ID = tx.Hash()
+
+	return tx
+}
+
+func TestCheckReplacement(t *testing.T) {
+	savedMempool, savedPolicy := mempool, activePolicy
+	defer func() { mempool, activePolicy = savedMempool, savedPolicy }()
+
+	prev := []byte("prev")
+	// orig 可以被替换, child 花费它的输出; final 不能被替换
+	orig := testTx(2, TXInput{prev, 0, nil, MaxRBFSequence})
+	child := testTx(1, TXInput{orig.ID, 0, nil, MaxSequence})
+	final := testTx(1, TXInput{prev, 1, nil, MaxSequence})
+	origID, childID := hex.EncodeToString(orig.ID), hex.EncodeToString(child.ID)
+
+	tests := []struct {
+		name        string
+		tx          *Transaction
+		fee         int
+		minRelayFee int
+		want        []string
+		wantErr     string
+	}{
+		{
+			name: "no conflict",
+			tx:   testTx(1, TXInput{prev, 2, nil, MaxSequence}),
+			fee:  1,
+			want: nil,
+		},
+		{
+			name: "replaces the conflict and its descendants",
+			tx:   testTx(1, TXInput{prev, 0, nil, MaxSequence}),
+			fee:  100,
+			want: []string{origID, childID},
+		},
+		{
+			name:    "conflict does not signal replacement",
+			tx:      testTx(1, TXInput{prev, 1, nil, MaxSequence}),
+			fee:     100,
+			wantErr: "txn-mempool-conflict",
+		},
+		{
+			name:    "fee rate is not higher",
+			tx:      testTx(2, TXInput{prev, 0, nil, MaxSequence}),
+			fee:     10,
+			wantErr: "fee rate is not higher",
+		},
+		{
+			name:    "does not pay for the replaced fees",
+			tx:      testTx(1, TXInput{prev, 0, nil, MaxSequence}),
+			fee:     15,
+			wantErr: "does not pay for the 15 replaced",
+		},
+		{
+			name:        "does not pay the relay fee for itself",
+			tx:          testTx(1, TXInput{prev, 0, nil, MaxSequence}),
+			fee:         16,
+			minRelayFee: 1000,
+			wantErr:     "insufficient fee",
+		},
+		{
+			name:    "spends a replaced transaction",
+			tx:      testTx(1, TXInput{prev, 0, nil, MaxSequence}, TXInput{orig.ID, 1, nil, MaxSequence}),
+			fee:     100,
+			wantErr: "bad-txns-spends-conflicting-tx",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mempool = NewMempool()
+			for _, add := range []struct {
+				tx  *Transaction
+				fee int
+			}{{orig, 10}, {child, 5}, {final, 10}} {
+				if err := mempool.Add(add.tx, add.fee, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			activePolicy = DefaultPolicy
+			activePolicy.MinRelayFee = test.minRelayFee
+
+			ids, err := checkReplacement(test.tx, test.fee)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("checkReplacement() error = %v, want %s", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sort.Strings(ids)
+			sort.Strings(test.want)
+			if !reflect.DeepEqual(ids, test.want) {
+				t.Errorf("checkReplacement() = %v, want %v", ids, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckReplacementTooManyEvictions(t *testing.T) {
+	savedMempool := mempool
+	defer func() { mempool = savedMempool }()
+	mempool = NewMempool()
+
+	prev := []byte("prev")
+	orig := testTx(maxReplacementEvictions, TXInput{prev, 0, nil, MaxRBFSequence})
+	if err := mempool.Add(orig, 10, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxReplacementEvictions; i++ {
+		if err := mempool.Add(testTx(1, TXInput{orig.ID, i, nil, MaxSequence}), 1, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := checkReplacement(testTx(1, TXInput{prev, 0, nil, MaxSequence}), 1000000)
+	if err == nil || !strings.Contains(err.Error(), "too many potential replacements") {
+		t.Errorf("checkReplacement() error = %v, want too many potential replacements", err)
+	}
+}
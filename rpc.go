@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+// 命令行查询正在运行的节点: 建立一个临时连接, 发送请求之后在同一个连接上等待同名的回复消息
+
+// nodeRPCAddress 命令行要访问的正在运行的节点, 由环境变量NODE_ADDR指定, 默认是NODE_ID对应的本地节点
+func nodeRPCAddress(nodeID string) string {
+	if addr := os.Getenv("NODE_ADDR"); addr != "" {
+		return addr
+	}
+
+	return fmt.Sprintf("localhost:%s", nodeID)
+}
+
+// submitTxWait 发送交易之后等待节点回复reject的时间, 节点接受交易时不会回复
+const submitTxWait = 2 * time.Second
+
+// submitTx 把命令行创建的交易发送给正在运行的节点, 由它验证并转发给其他节点
+// 命令行不是节点, 没有监听地址, 所以nodeAddress保持为空, 节点也不会向它转发任何消息.
+// 节点拒绝交易时在同一个连接上回复reject, 这里等待一小段时间并打印拒绝的原因
+func submitTx(nodeID string, tnx *Transaction) {
+	addr := nodeRPCAddress(nodeID)
+	conn, err := dial(addr)
+	if err != nil {
+		log.Panicf("Node %s is not running: %s", addr, err)
+	}
+	defer conn.Close()
+
+	// 交易不是查询命令, 节点要求先发送version
+	version := verzion{nodeVersion, 0, nodeAddress, time.Now().Unix(), localServices}
+	err = WriteMessage(conn, "version", gobEncode(version))
+	if err == nil {
+		err = WriteMessage(conn, "tx", gobEncode(tx{nodeAddress, tnx.Serialize()}))
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("[sendTx to %s]: Transaction 0x%x\n\n", addr, tnx.ID)
+
+	conn.SetReadDeadline(time.Now().Add(submitTxWait))
+	for {
+		command, payload, err := ReadMessage(conn)
+		if err != nil {
+			// 超时或者节点关闭了连接, 都说明没有收到拒绝
+			fmt.Printf("Transaction 0x%x is sent to %s\n", tnx.ID, addr)
+			return
+		}
+		if command != "reject" {
+			continue
+		}
+
+		var rej reject
+		err = gob.NewDecoder(bytes.NewReader(payload)).Decode(&rej)
+		if err != nil {
+			log.Panic(err)
+		}
+		if bytes.Equal(rej.ID, tnx.ID) {
+			fmt.Printf("Transaction 0x%x is rejected by %s: %s\n", tnx.ID, addr, rej.Reason)
+			return
+		}
+	}
+}
+
+// isRPCCommand 命令行的查询命令, 不需要先握手
+func isRPCCommand(command string) bool {
+	return command == "mempoolinfo" || command == "getpeerinfo"
+}
+
+// callNode 向节点addr发送查询, 返回回复的payload
+func callNode(addr, command string, data interface{}) []byte {
+	conn, err := net.Dial(protocol, addr)
+	if err != nil {
+		log.Panicf("Node %s is not running: %s", addr, err)
+	}
+	defer conn.Close()
+
+	err = WriteMessage(conn, command, gobEncode(data))
+	if err != nil {
+		log.Panic(err)
+	}
+
+	replyCommand, reply, err := ReadMessage(conn)
+	if err != nil {
+		log.Panic(err)
+	}
+	if replyCommand != command {
+		log.Panicf("Node %s replied %s to %s", addr, replyCommand, command)
+	}
+
+	return reply
+}
+
+// sendReply 把查询的结果发回请求所在的连接
+func sendReply(peer *Peer, command string, data interface{}) {
+	err := peer.Send(command, gobEncode(data))
+	if err != nil {
+		log.Printf("Reply to %s failed: %s\n", peer.Addr(), err)
+	}
+}
+
+// mempoolinfo getmempoolinfo的请求
+type mempoolinfo struct {
+	AddrFrom string
+}
+
+func handleMempoolInfo(peer *Peer) {
+	sendReply(peer, "mempoolinfo", mempool.Info())
+}
+
+// getMempoolInfo 查询节点的交易池, 节点地址见nodeRPCAddress
+func getMempoolInfo(nodeID string) MempoolInfo {
+	reply := callNode(nodeRPCAddress(nodeID), "mempoolinfo", mempoolinfo{})
+
+	var info MempoolInfo
+	err := gob.NewDecoder(bytes.NewReader(reply)).Decode(&info)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return info
+}
+
+// getpeerinfo getpeerinfo的请求
+type getpeerinfo struct {
+	AddrFrom string
+}
+
+func handleGetPeerInfo(peer *Peer) {
+	sendReply(peer, "getpeerinfo", peers.Info(peer))
+}
+
+// getPeerInfo 查询节点当前的连接, 节点地址见nodeRPCAddress
+func getPeerInfo(nodeID string) []PeerInfo {
+	reply := callNode(nodeRPCAddress(nodeID), "getpeerinfo", getpeerinfo{})
+
+	var infos []PeerInfo
+	err := gob.NewDecoder(bytes.NewReader(reply)).Decode(&infos)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return infos
+}
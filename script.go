@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Script 锁定脚本(ScriptPubKey)或者解锁脚本(ScriptSig)的字节码
+type Script []byte
+
+// parsedOpcode 解析之后的一条指令, data是要压栈的数据
+type parsedOpcode struct {
+	op   byte
+	data []byte
+}
+
+// parseScript 把字节码解析成指令列表
+func parseScript(script Script) ([]parsedOpcode, error) {
+	var ops []parsedOpcode
+
+	for i := 0; i < len(script); {
+		op := script[i]
+		i++
+
+		dataLen := 0
+		switch {
+		case op > OP_0 && op < OP_PUSHDATA1:
+			dataLen = int(op)
+		case op == OP_PUSHDATA1:
+			if i+1 > len(script) {
+				return nil, errors.New("Script is truncated")
+			}
+			dataLen = int(script[i])
+			i++
+		case op == OP_PUSHDATA2:
+			if i+2 > len(script) {
+				return nil, errors.New("Script is truncated")
+			}
+			dataLen = int(binary.LittleEndian.Uint16(script[i:]))
+			i += 2
+		case op == OP_PUSHDATA4:
+			if i+4 > len(script) {
+				return nil, errors.New("Script is truncated")
+			}
+			dataLen = int(binary.LittleEndian.Uint32(script[i:]))
+			i += 4
+		}
+
+		if dataLen < 0 || i+dataLen > len(script) {
+			return nil, errors.New("Script is truncated")
+		}
+
+		var data []byte
+		if op > OP_0 && op <= OP_PUSHDATA4 {
+			data = script[i : i+dataLen]
+		}
+		i += dataLen
+
+		ops = append(ops, parsedOpcode{op, data})
+	}
+
+	return ops, nil
+}
+
+// IsPushOnly 脚本是否只包含压栈指令, 解锁脚本必须满足这个条件
+func (s Script) IsPushOnly() bool {
+	ops, err := parseScript(s)
+	if err != nil {
+		return false
+	}
+
+	for _, pop := range ops {
+		if !isPushOp(pop.op) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// IsUnspendable 以OP_RETURN开头的脚本一定执行失败, 它锁定的输出不需要放进UTXO集合
+func (s Script) IsUnspendable() bool {
+	return len(s) > 0 && s[0] == OP_RETURN
+}
+
+// PushedData 返回脚本里面所有压栈的数据
+func (s Script) PushedData() ([][]byte, error) {
+	ops, err := parseScript(s)
+	if err != nil {
+		return nil, err
+	}
+
+	var data [][]byte
+	for _, pop := range ops {
+		if pop.data != nil {
+			data = append(data, pop.data)
+		}
+	}
+
+	return data, nil
+}
+
+// String 返回脚本的反汇编, 例如 OP_DUP OP_HASH160 <hash> OP_EQUALVERIFY OP_CHECKSIG
+func (s Script) String() string {
+	var words []string
+
+	ops, err := parseScript(s)
+	for _, pop := range ops {
+		switch {
+		case pop.data != nil:
+			words = append(words, hex.EncodeToString(pop.data))
+		case isSmallInt(pop.op):
+			words = append(words, fmt.Sprintf("OP_%d", asSmallInt(pop.op)))
+		case opcodeNames[pop.op] != "":
+			words = append(words, opcodeNames[pop.op])
+		default:
+			words = append(words, fmt.Sprintf("OP_UNKNOWN%d", pop.op))
+		}
+	}
+
+	if err != nil {
+		words = append(words, "[error]")
+	}
+
+	return strings.Join(words, " ")
+}
+
+// ScriptBuilder 用于拼接脚本
+type ScriptBuilder struct {
+	script Script
+}
+
+// NewScriptBuilder 创建一个空的ScriptBuilder
+func NewScriptBuilder() *ScriptBuilder {
+	return &ScriptBuilder{}
+}
+
+// AddOp 添加一个操作码
+func (b *ScriptBuilder) AddOp(op byte) *ScriptBuilder {
+	b.script = append(b.script, op)
+	return b
+}
+
+// AddData 添加一段压栈的数据, 根据长度选择最短的压栈方式
+func (b *ScriptBuilder) AddData(data []byte) *ScriptBuilder {
+	dataLen := len(data)
+
+	switch {
+	case dataLen == 0:
+		b.script = append(b.script, OP_0)
+		return b
+	case dataLen < OP_PUSHDATA1:
+		b.script = append(b.script, byte(dataLen))
+	case dataLen <= 0xff:
+		b.script = append(b.script, OP_PUSHDATA1, byte(dataLen))
+	case dataLen <= 0xffff:
+		var buf [2]byte
+		binary.LittleEndian.PutUint16(buf[:], uint16(dataLen))
+		b.script = append(append(b.script, OP_PUSHDATA2), buf[:]...)
+	default:
+		var buf [4]byte
+		binary.LittleEndian.PutUint32(buf[:], uint32(dataLen))
+		b.script = append(append(b.script, OP_PUSHDATA4), buf[:]...)
+	}
+
+	b.script = append(b.script, data...)
+	return b
+}
+
+// AddInt64 添加一个数字, 0到16以及-1直接使用对应的操作码
+func (b *ScriptBuilder) AddInt64(n int64) *ScriptBuilder {
+	switch {
+	case n == 0:
+		return b.AddOp(OP_0)
+	case n == -1:
+		return b.AddOp(OP_1NEGATE)
+	case n >= 1 && n <= 16:
+		return b.AddOp(byte(OP_1 - 1 + n))
+	}
+
+	return b.AddData(scriptNumBytes(n))
+}
+
+// Script 返回拼接好的脚本
+func (b *ScriptBuilder) Script() Script {
+	return b.script
+}
+
+// scriptNumBytes 把数字编码成脚本里面使用的小端序, 最高位表示符号的格式
+func scriptNumBytes(n int64) []byte {
+	if n == 0 {
+		return nil
+	}
+
+	negative := n < 0
+	if negative {
+		n = -n
+	}
+
+	var result []byte
+	for n > 0 {
+		result = append(result, byte(n&0xff))
+		n >>= 8
+	}
+
+	// 最高位已经被占用时, 需要多加一个字节来保存符号
+	if result[len(result)-1]&0x80 != 0 {
+		extra := byte(0x00)
+		if negative {
+			extra = 0x80
+		}
+		result = append(result, extra)
+	} else if negative {
+		result[len(result)-1] |= 0x80
+	}
+
+	return result
+}
+
+// makeScriptNum 把栈上的数据解码成数字, 超过maxLen个字节的数据不是合法的数字
+func makeScriptNum(v []byte, maxLen int) (int64, error) {
+	if len(v) > maxLen {
+		return 0, fmt.Errorf("Numeric value is longer than %d bytes", maxLen)
+	}
+
+	if len(v) == 0 {
+		return 0, nil
+	}
+
+	var result int64
+	for i, b := range v {
+		result |= int64(b) << uint8(8*i)
+	}
+
+	if v[len(v)-1]&0x80 != 0 {
+		result &= ^(int64(0x80) << uint8(8*(len(v)-1)))
+		return -result, nil
+	}
+
+	return result, nil
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// 脚本执行的限制, 防止恶意脚本耗尽节点资源
+const (
+	maxScriptSize         = 10000
+	maxOpsPerScript       = 201
+	maxStackSize          = 1000
+	maxScriptElementSize  = 520
+	maxPubKeysPerMultiSig = 20
+	// 时间锁用到的数字最多5个字节, 这样才能表示uint32
+	lockTimeNumLen = 5
+	// 其他数字最多4个字节
+	defaultScriptNumLen = 4
+)
+
+// Engine 执行一个输入的解锁脚本和它引用的输出的锁定脚本, 判断这个输入能否花费该输出
+type Engine struct {
+	tx           *Transaction
+	inputIdx     int
+	scriptPubKey Script
+
+	stack     [][]byte
+	condStack []bool
+	// subScript 当前正在执行的脚本, 签名验证的时候要用到
+	subScript Script
+	numOps    int
+}
+
+// NewEngine 为tx的第inputIdx个输入创建执行引擎, scriptPubKey是该输入引用的输出的锁定脚本
+func NewEngine(scriptPubKey Script, tx *Transaction, inputIdx int) (*Engine, error) {
+	if inputIdx < 0 || inputIdx >= len(tx.Vin) {
+		return nil, fmt.Errorf("Input index %d is out of range", inputIdx)
+	}
+
+	return &Engine{tx: tx, inputIdx: inputIdx, scriptPubKey: scriptPubKey}, nil
+}
+
+// Execute 先执行解锁脚本, 再用得到的栈执行锁定脚本, 最后栈顶为真表示验证通过
+// 锁定脚本是P2SH的时候, 解锁脚本最后压栈的是赎回脚本, 哈希验证通过之后再用剩下的栈执行赎回脚本
+func (vm *Engine) Execute() error {
+	scriptSig := vm.tx.Vin[vm.inputIdx].ScriptSig
+	if !scriptSig.IsPushOnly() {
+		return errors.New("ScriptSig is not push only")
+	}
+
+	err := vm.executeScript(scriptSig)
+	if err != nil {
+		return err
+	}
+
+	var savedStack [][]byte
+	isScriptHash := GetScriptClass(vm.scriptPubKey) == ScriptHashTy
+	if isScriptHash {
+		savedStack = append(savedStack, vm.stack...)
+	}
+
+	err = vm.executeScript(vm.scriptPubKey)
+	if err != nil {
+		return err
+	}
+
+	err = vm.checkStackTop()
+	if err != nil || !isScriptHash {
+		return err
+	}
+
+	if len(savedStack) == 0 {
+		return errors.New("Missing redeem script")
+	}
+	redeemScript := Script(savedStack[len(savedStack)-1])
+	vm.stack = savedStack[:len(savedStack)-1]
+
+	err = vm.executeScript(redeemScript)
+	if err != nil {
+		return err
+	}
+
+	return vm.checkStackTop()
+}
+
+// checkStackTop 脚本执行完之后栈顶必须为真
+func (vm *Engine) checkStackTop() error {
+	if len(vm.stack) == 0 || !castToBool(vm.stack[len(vm.stack)-1]) {
+		return errors.New("Script evaluated to false")
+	}
+
+	return nil
+}
+
+// executeScript 在当前栈上执行一段脚本
+func (vm *Engine) executeScript(script Script) error {
+	if len(script) > maxScriptSize {
+		return fmt.Errorf("Script size %d exceeds limit %d", len(script), maxScriptSize)
+	}
+
+	ops, err := parseScript(script)
+	if err != nil {
+		return err
+	}
+
+	vm.subScript = script
+	vm.numOps = 0
+	vm.condStack = nil
+
+	for _, pop := range ops {
+		if len(pop.data) > maxScriptElementSize {
+			return fmt.Errorf("Pushed data size %d exceeds limit %d", len(pop.data), maxScriptElementSize)
+		}
+
+		if !isPushOp(pop.op) {
+			vm.numOps++
+			if vm.numOps > maxOpsPerScript {
+				return fmt.Errorf("Script has more than %d operations", maxOpsPerScript)
+			}
+		}
+
+		// 处在不执行的条件分支里面时, 只处理条件操作码
+		if !vm.isBranchExecuting() && (pop.op < OP_IF || pop.op > OP_ENDIF) {
+			continue
+		}
+
+		err = vm.executeOpcode(pop)
+		if err != nil {
+			return err
+		}
+
+		if len(vm.stack) > maxStackSize {
+			return fmt.Errorf("Stack size exceeds limit %d", maxStackSize)
+		}
+	}
+
+	if len(vm.condStack) != 0 {
+		return errors.New("Unbalanced conditional")
+	}
+
+	return nil
+}
+
+func (vm *Engine) isBranchExecuting() bool {
+	for _, cond := range vm.condStack {
+		if !cond {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (vm *Engine) executeOpcode(pop parsedOpcode) error {
+	op := pop.op
+
+	switch {
+	case op == OP_0:
+		vm.push(nil)
+		return nil
+	case op <= OP_PUSHDATA4:
+		vm.push(pop.data)
+		return nil
+	case op == OP_1NEGATE:
+		vm.push(scriptNumBytes(-1))
+		return nil
+	case op >= OP_1 && op <= OP_16:
+		vm.push(scriptNumBytes(int64(asSmallInt(op))))
+		return nil
+	}
+
+	switch op {
+	case OP_NOP:
+
+	case OP_IF, OP_NOTIF:
+		cond := false
+		if vm.isBranchExecuting() {
+			v, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			cond = castToBool(v)
+			if op == OP_NOTIF {
+				cond = !cond
+			}
+		}
+		vm.condStack = append(vm.condStack, cond)
+
+	case OP_ELSE:
+		if len(vm.condStack) == 0 {
+			return errors.New("OP_ELSE without OP_IF")
+		}
+		vm.condStack[len(vm.condStack)-1] = !vm.condStack[len(vm.condStack)-1]
+
+	case OP_ENDIF:
+		if len(vm.condStack) == 0 {
+			return errors.New("OP_ENDIF without OP_IF")
+		}
+		vm.condStack = vm.condStack[:len(vm.condStack)-1]
+
+	case OP_VERIFY:
+		return vm.verify("OP_VERIFY")
+
+	case OP_RETURN:
+		return errors.New("OP_RETURN: output is unspendable")
+
+	case OP_DROP:
+		_, err := vm.pop()
+		return err
+
+	case OP_DUP:
+		v, err := vm.peek()
+		if err != nil {
+			return err
+		}
+		vm.push(v)
+
+	case OP_EQUAL, OP_EQUALVERIFY:
+		a, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		b, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		vm.pushBool(bytes.Compare(a, b) == 0)
+		if op == OP_EQUALVERIFY {
+			return vm.verify("OP_EQUALVERIFY")
+		}
+
+	case OP_SHA256:
+		v, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(v)
+		vm.push(hash[:])
+
+	case OP_HASH160:
+		v, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		vm.push(HashPubKey(v))
+
+	case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+		pubKey, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		sig, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		vm.pushBool(vm.checkSignature(sig, pubKey))
+		if op == OP_CHECKSIGVERIFY {
+			return vm.verify("OP_CHECKSIGVERIFY")
+		}
+
+	case OP_CHECKMULTISIG, OP_CHECKMULTISIGVERIFY:
+		err := vm.checkMultiSig()
+		if err != nil {
+			return err
+		}
+		if op == OP_CHECKMULTISIGVERIFY {
+			return vm.verify("OP_CHECKMULTISIGVERIFY")
+		}
+
+	case OP_CHECKLOCKTIMEVERIFY:
+		return vm.checkLockTimeVerify()
+
+	case OP_CHECKSEQUENCEVERIFY:
+		return vm.checkSequenceVerify()
+
+	default:
+		return fmt.Errorf("Invalid opcode 0x%x", op)
+	}
+
+	return nil
+}
+
+// checkMultiSig 栈上的格式为 <sig1> ... <sigM> M <pubKey1> ... <pubKeyN> N, 签名的顺序必须和公钥的顺序一致
+// 和比特币不同, 这里没有多弹出一个无用的元素
+func (vm *Engine) checkMultiSig() error {
+	numPubKeys, err := vm.popInt()
+	if err != nil {
+		return err
+	}
+	if numPubKeys < 0 || numPubKeys > maxPubKeysPerMultiSig {
+		return fmt.Errorf("Invalid number of public keys %d", numPubKeys)
+	}
+	vm.numOps += int(numPubKeys)
+	if vm.numOps > maxOpsPerScript {
+		return fmt.Errorf("Script has more than %d operations", maxOpsPerScript)
+	}
+
+	pubKeys := make([][]byte, numPubKeys)
+	for i := len(pubKeys) - 1; i >= 0; i-- {
+		pubKeys[i], err = vm.pop()
+		if err != nil {
+			return err
+		}
+	}
+
+	numSigs, err := vm.popInt()
+	if err != nil {
+		return err
+	}
+	if numSigs < 0 || numSigs > numPubKeys {
+		return fmt.Errorf("Invalid number of signatures %d", numSigs)
+	}
+
+	sigs := make([][]byte, numSigs)
+	for i := len(sigs) - 1; i >= 0; i-- {
+		sigs[i], err = vm.pop()
+		if err != nil {
+			return err
+		}
+	}
+
+	success := true
+	for len(sigs) > 0 {
+		// 剩下的公钥不够匹配剩下的签名了
+		if len(pubKeys) < len(sigs) {
+			success = false
+			break
+		}
+
+		if vm.checkSignature(sigs[0], pubKeys[0]) {
+			sigs = sigs[1:]
+		}
+		pubKeys = pubKeys[1:]
+	}
+
+	vm.pushBool(success)
+	return nil
+}
+
+// checkLockTimeVerify 栈顶的数字不能大于交易的LockTime, 而且两者必须同为高度或者同为时间
+func (vm *Engine) checkLockTimeVerify() error {
+	v, err := vm.peek()
+	if err != nil {
+		return err
+	}
+	lockTime, err := makeScriptNum(v, lockTimeNumLen)
+	if err != nil {
+		return err
+	}
+
+	if lockTime < 0 {
+		return errors.New("Negative locktime")
+	}
+
+	txLockTime := int64(vm.tx.LockTime)
+	if (lockTime < lockTimeThreshold) != (txLockTime < lockTimeThreshold) {
+		return errors.New("Locktime type mismatch")
+	}
+	if lockTime > txLockTime {
+		return fmt.Errorf("Locktime requirement not satisfied: %d > %d", lockTime, txLockTime)
+	}
+
+	// 序列号是最大值时交易的LockTime不生效, 这里也就不能通过
+	if vm.tx.Vin[vm.inputIdx].Sequence == MaxSequence {
+		return errors.New("Transaction input is finalized")
+	}
+
+	return nil
+}
+
+// checkSequenceVerify 栈顶的相对时间锁不能大于输入的序列号, 而且两者的类型必须一致
+func (vm *Engine) checkSequenceVerify() error {
+	v, err := vm.peek()
+	if err != nil {
+		return err
+	}
+	stackSequence, err := makeScriptNum(v, lockTimeNumLen)
+	if err != nil {
+		return err
+	}
+
+	if stackSequence < 0 {
+		return errors.New("Negative sequence")
+	}
+
+	// 设置了禁用位时相当于OP_NOP
+	if stackSequence&sequenceLockTimeDisableFlag != 0 {
+		return nil
+	}
+
+	txSequence := int64(vm.tx.Vin[vm.inputIdx].Sequence)
+	if txSequence&sequenceLockTimeDisableFlag != 0 {
+		return errors.New("Transaction sequence has disable flag set")
+	}
+
+	mask := int64(sequenceLockTimeTypeFlag | sequenceLockTimeMask)
+	stackSequence &= mask
+	txSequence &= mask
+
+	if (stackSequence < sequenceLockTimeTypeFlag) != (txSequence < sequenceLockTimeTypeFlag) {
+		return errors.New("Sequence type mismatch")
+	}
+	if stackSequence > txSequence {
+		return fmt.Errorf("Sequence requirement not satisfied: %d > %d", stackSequence, txSequence)
+	}
+
+	return nil
+}
+
+// checkSignature 用当前执行的脚本计算签名数据, 然后验证签名
+func (vm *Engine) checkSignature(sig, pubKey []byte) bool {
+	hash := vm.tx.SignatureHash(vm.inputIdx, vm.subScript)
+
+	return verifySignature(hash, sig, pubKey)
+}
+
+// verifySignature 检查sig是不是pubKey对应的私钥对hash的签名
+func verifySignature(hash, sig, pubKey []byte) bool {
+	if len(sig) == 0 || len(sig)%2 != 0 || len(pubKey) == 0 || len(pubKey)%2 != 0 {
+		return false
+	}
+
+	r := big.Int{}
+	s := big.Int{}
+	sigLen := len(sig)
+	r.SetBytes(sig[:(sigLen / 2)])
+	s.SetBytes(sig[(sigLen / 2):])
+
+	x := big.Int{}
+	y := big.Int{}
+	keyLen := len(pubKey)
+	x.SetBytes(pubKey[:(keyLen / 2)])
+	y.SetBytes(pubKey[(keyLen / 2):])
+
+	curve := elliptic.P256()
+	if !curve.IsOnCurve(&x, &y) {
+		return false
+	}
+	rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
+
+	return ecdsa.Verify(&rawPubKey, hash, &r, &s)
+}
+
+func (vm *Engine) push(v []byte) {
+	vm.stack = append(vm.stack, v)
+}
+
+func (vm *Engine) pushBool(v bool) {
+	if v {
+		vm.push([]byte{1})
+	} else {
+		vm.push(nil)
+	}
+}
+
+func (vm *Engine) pop() ([]byte, error) {
+	v, err := vm.peek()
+	if err != nil {
+		return nil, err
+	}
+	vm.stack = vm.stack[:len(vm.stack)-1]
+
+	return v, nil
+}
+
+func (vm *Engine) peek() ([]byte, error) {
+	if len(vm.stack) == 0 {
+		return nil, errors.New("Stack is empty")
+	}
+
+	return vm.stack[len(vm.stack)-1], nil
+}
+
+func (vm *Engine) popInt() (int64, error) {
+	v, err := vm.pop()
+	if err != nil {
+		return 0, err
+	}
+
+	return makeScriptNum(v, defaultScriptNumLen)
+}
+
+// verify 弹出栈顶, 为假时脚本执行失败
+func (vm *Engine) verify(opName string) error {
+	v, err := vm.pop()
+	if err != nil {
+		return err
+	}
+	if !castToBool(v) {
+		return fmt.Errorf("%s failed", opName)
+	}
+
+	return nil
+}
+
+// castToBool 全部为0(包括负0)的数据为假, 其他为真
+func castToBool(v []byte) bool {
+	for i, b := range v {
+		if b != 0 {
+			// 最后一个字节是0x80表示负0
+			if i == len(v)-1 && b == 0x80 {
+				return false
+			}
+			return true
+		}
+	}
+
+	return false
+}
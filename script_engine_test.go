@@ -0,0 +1,264 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestEngineExecute(t *testing.T) {
+	priv1, pub1 := newKeyPair()
+	priv2, pub2 := newKeyPair()
+
+	p2pkh := PayToPubKeyHashScript(HashPubKey(pub1))
+	multiSig, err := MultiSigScript(2, [][]byte{pub1, pub2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2sh := PayToScriptHashScript(HashPubKey(multiSig))
+	trueScript := NewScriptBuilder().AddOp(OP_1).Script()
+
+	// 时间锁: 高度10之后, 或者输入确认5个区块之后
+	cltv := NewScriptBuilder().AddInt64(10).AddOp(OP_CHECKLOCKTIMEVERIFY).AddOp(OP_DROP).AddOp(OP_1).Script()
+	csv := NewScriptBuilder().AddInt64(5).AddOp(OP_CHECKSEQUENCEVERIFY).AddOp(OP_DROP).AddOp(OP_1).Script()
+
+	// 解锁脚本依赖交易的签名数据, 所以用函数在交易创建好之后生成
+	constSig := func(script Script) func(*Transaction) Script {
+		return func(*Transaction) Script { return script }
+	}
+
+	tests := []struct {
+		name         string
+		scriptPubKey Script
+		scriptSig    func(tx *Transaction) Script
+		lockTime     uint32
+		sequence     uint32
+		wantErr      bool
+	}{
+		{
+			name:         "true",
+			scriptPubKey: nil,
+			scriptSig:    constSig(trueScript),
+			sequence:     MaxSequence,
+		},
+		{
+			name:         "false",
+			scriptPubKey: nil,
+			scriptSig:    constSig(NewScriptBuilder().AddOp(OP_0).Script()),
+			sequence:     MaxSequence,
+			wantErr:      true,
+		},
+		{
+			name:         "empty stack",
+			scriptPubKey: nil,
+			scriptSig:    constSig(nil),
+			sequence:     MaxSequence,
+			wantErr:      true,
+		},
+		{
+			name:         "scriptSig not push only",
+			scriptPubKey: trueScript,
+			scriptSig:    constSig(NewScriptBuilder().AddOp(OP_1).AddOp(OP_DUP).Script()),
+			sequence:     MaxSequence,
+			wantErr:      true,
+		},
+		{
+			name:         "op_return",
+			scriptPubKey: NewScriptBuilder().AddOp(OP_RETURN).Script(),
+			scriptSig:    constSig(trueScript),
+			sequence:     MaxSequence,
+			wantErr:      true,
+		},
+		{
+			name:         "invalid opcode",
+			scriptPubKey: Script{0xff},
+			scriptSig:    constSig(trueScript),
+			sequence:     MaxSequence,
+			wantErr:      true,
+		},
+		{
+			name:         "if else",
+			scriptPubKey: NewScriptBuilder().AddOp(OP_IF).AddOp(OP_0).AddOp(OP_ELSE).AddOp(OP_1).AddOp(OP_ENDIF).Script(),
+			scriptSig:    constSig(NewScriptBuilder().AddOp(OP_0).Script()),
+			sequence:     MaxSequence,
+		},
+		{
+			name:         "unbalanced conditional",
+			scriptPubKey: NewScriptBuilder().AddOp(OP_IF).AddOp(OP_1).Script(),
+			scriptSig:    constSig(trueScript),
+			sequence:     MaxSequence,
+			wantErr:      true,
+		},
+		{
+			name:         "else without if",
+			scriptPubKey: NewScriptBuilder().AddOp(OP_ELSE).AddOp(OP_1).Script(),
+			scriptSig:    constSig(nil),
+			sequence:     MaxSequence,
+			wantErr:      true,
+		},
+		{
+			name:         "p2pkh",
+			scriptPubKey: p2pkh,
+			scriptSig: func(tx *Transaction) Script {
+				return SignatureScript(tx.SignInput(priv1, 0, p2pkh), pub1)
+			},
+			sequence: MaxSequence,
+		},
+		{
+			name:         "p2pkh wrong key",
+			scriptPubKey: p2pkh,
+			scriptSig: func(tx *Transaction) Script {
+				return SignatureScript(tx.SignInput(priv2, 0, p2pkh), pub2)
+			},
+			sequence: MaxSequence,
+			wantErr:  true,
+		},
+		{
+			name:         "p2pkh signature of another key",
+			scriptPubKey: p2pkh,
+			scriptSig: func(tx *Transaction) Script {
+				return SignatureScript(tx.SignInput(priv2, 0, p2pkh), pub1)
+			},
+			sequence: MaxSequence,
+			wantErr:  true,
+		},
+		{
+			name:         "p2pkh signature of another script",
+			scriptPubKey: p2pkh,
+			scriptSig: func(tx *Transaction) Script {
+				return SignatureScript(tx.SignInput(priv1, 0, trueScript), pub1)
+			},
+			sequence: MaxSequence,
+			wantErr:  true,
+		},
+		{
+			name:         "p2sh multisig",
+			scriptPubKey: p2sh,
+			scriptSig: func(tx *Transaction) Script {
+				sigs := [][]byte{tx.SignInput(priv1, 0, multiSig), tx.SignInput(priv2, 0, multiSig)}
+				return MultiSigSignatureScript(sigs, multiSig)
+			},
+			sequence: MaxSequence,
+		},
+		{
+			name:         "p2sh multisig wrong order",
+			scriptPubKey: p2sh,
+			scriptSig: func(tx *Transaction) Script {
+				sigs := [][]byte{tx.SignInput(priv2, 0, multiSig), tx.SignInput(priv1, 0, multiSig)}
+				return MultiSigSignatureScript(sigs, multiSig)
+			},
+			sequence: MaxSequence,
+			wantErr:  true,
+		},
+		{
+			name:         "p2sh multisig missing signature",
+			scriptPubKey: p2sh,
+			scriptSig: func(tx *Transaction) Script {
+				return MultiSigSignatureScript([][]byte{tx.SignInput(priv1, 0, multiSig)}, multiSig)
+			},
+			sequence: MaxSequence,
+			wantErr:  true,
+		},
+		{
+			name:         "p2sh wrong redeem script",
+			scriptPubKey: p2sh,
+			scriptSig:    constSig(NewScriptBuilder().AddData(trueScript).Script()),
+			sequence:     MaxSequence,
+			wantErr:      true,
+		},
+		{
+			name:         "p2sh redeem script evaluates to false",
+			scriptPubKey: PayToScriptHashScript(HashPubKey(Script{OP_0})),
+			scriptSig:    constSig(NewScriptBuilder().AddData(Script{OP_0}).Script()),
+			sequence:     MaxSequence,
+			wantErr:      true,
+		},
+		{
+			name:         "cltv satisfied",
+			scriptPubKey: cltv,
+			scriptSig:    constSig(nil),
+			lockTime:     10,
+			sequence:     MaxSequence - 1,
+		},
+		{
+			name:         "cltv not reached",
+			scriptPubKey: cltv,
+			scriptSig:    constSig(nil),
+			lockTime:     9,
+			sequence:     MaxSequence - 1,
+			wantErr:      true,
+		},
+		{
+			name:         "cltv type mismatch",
+			scriptPubKey: cltv,
+			scriptSig:    constSig(nil),
+			lockTime:     lockTimeThreshold + 10,
+			sequence:     MaxSequence - 1,
+			wantErr:      true,
+		},
+		{
+			name:         "cltv input finalized",
+			scriptPubKey: cltv,
+			scriptSig:    constSig(nil),
+			lockTime:     10,
+			sequence:     MaxSequence,
+			wantErr:      true,
+		},
+		{
+			name:         "csv satisfied",
+			scriptPubKey: csv,
+			scriptSig:    constSig(nil),
+			sequence:     5,
+		},
+		{
+			name:         "csv not reached",
+			scriptPubKey: csv,
+			scriptSig:    constSig(nil),
+			sequence:     4,
+			wantErr:      true,
+		},
+		{
+			name:         "csv type mismatch",
+			scriptPubKey: csv,
+			scriptSig:    constSig(nil),
+			sequence:     sequenceLockTimeTypeFlag | 5,
+			wantErr:      true,
+		},
+		{
+			name:         "csv disabled on input",
+			scriptPubKey: csv,
+			scriptSig:    constSig(nil),
+			sequence:     MaxSequence,
+			wantErr:      true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tx := &Transaction{
+				Vin:      []TXInput{{[]byte("prev"), 0, nil, test.sequence}},
+				Vout:     []TXOutput{{1, p2pkh}},
+				LockTime: test.lockTime,
+			}
+			tx.ID = tx.Hash()
+			tx.Vin[0].ScriptSig = test.scriptSig(tx)
+
+			vm, err := NewEngine(test.scriptPubKey, tx, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = vm.Execute()
+			if (err != nil) != test.wantErr {
+				t.Errorf("Execute() error = %v, wantErr %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewEngineInputIndex(t *testing.T) {
+	tx := &Transaction{Vin: []TXInput{{[]byte("prev"), 0, nil, MaxSequence}}}
+
+	for _, idx := range []int{-1, 1} {
+		if _, err := NewEngine(nil, tx, idx); err == nil {
+			t.Errorf("NewEngine(%d) succeeded with one input", idx)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// ScriptClass 标准锁定脚本的类型
+type ScriptClass int
+
+const (
+	// NonStandardTy 不属于下面任何一种模板
+	NonStandardTy ScriptClass = iota
+	// PubKeyHashTy OP_DUP OP_HASH160 <pubKeyHash> OP_EQUALVERIFY OP_CHECKSIG
+	PubKeyHashTy
+	// ScriptHashTy OP_HASH160 <scriptHash> OP_EQUAL, 花费的时候要提供赎回脚本
+	ScriptHashTy
+	// MultiSigTy M <pubKey1> ... <pubKeyN> N OP_CHECKMULTISIG
+	MultiSigTy
+	// NullDataTy OP_RETURN <data>, 只用来携带数据, 永远不能被花费
+	NullDataTy
+)
+
+var scriptClassNames = map[ScriptClass]string{
+	NonStandardTy: "nonstandard",
+	PubKeyHashTy:  "pubkeyhash",
+	ScriptHashTy:  "scripthash",
+	MultiSigTy:    "multisig",
+	NullDataTy:    "nulldata",
+}
+
+func (class ScriptClass) String() string {
+	return scriptClassNames[class]
+}
+
+// pubKeyHashLen HashPubKey得到的RIPEMD160哈希长度
+const pubKeyHashLen = 20
+
+// PayToPubKeyHashScript 创建标准的P2PKH锁定脚本
+func PayToPubKeyHashScript(pubKeyHash []byte) Script {
+	return NewScriptBuilder().
+		AddOp(OP_DUP).
+		AddOp(OP_HASH160).
+		AddData(pubKeyHash).
+		AddOp(OP_EQUALVERIFY).
+		AddOp(OP_CHECKSIG).
+		Script()
+}
+
+// PayToScriptHashScript 创建P2SH锁定脚本
+func PayToScriptHashScript(scriptHash []byte) Script {
+	return NewScriptBuilder().
+		AddOp(OP_HASH160).
+		AddData(scriptHash).
+		AddOp(OP_EQUAL).
+		Script()
+}
+
+// MultiSigScript 创建M-of-N多重签名脚本, 一般作为P2SH的赎回脚本使用
+func MultiSigScript(m int, pubKeys [][]byte) (Script, error) {
+	if len(pubKeys) == 0 || len(pubKeys) > maxPubKeysPerMultiSig || len(pubKeys) > 16 {
+		return nil, fmt.Errorf("Invalid number of public keys %d", len(pubKeys))
+	}
+	if m < 1 || m > len(pubKeys) {
+		return nil, fmt.Errorf("Invalid number of required signatures %d", m)
+	}
+
+	builder := NewScriptBuilder().AddInt64(int64(m))
+	for _, pubKey := range pubKeys {
+		builder.AddData(pubKey)
+	}
+	builder.AddInt64(int64(len(pubKeys))).AddOp(OP_CHECKMULTISIG)
+
+	return builder.Script(), nil
+}
+
+// PayToAddrScript 根据地址创建锁定脚本
+func PayToAddrScript(address string) (Script, error) {
+	if !ValidateAddress(address) {
+		return nil, fmt.Errorf("Address %s is not valid", address)
+	}
+
+	addrVersion, hash := DecodeAddress(address)
+	switch addrVersion {
+	case version:
+		return PayToPubKeyHashScript(hash), nil
+	case scriptHashVersion:
+		return PayToScriptHashScript(hash), nil
+	}
+
+	return nil, fmt.Errorf("Address %s has unknown version %d", address, addrVersion)
+}
+
+// NullDataScript 创建携带data的OP_RETURN脚本, data的长度不能超过当前网络的MaxDataCarrierSize
+func NullDataScript(data []byte) (Script, error) {
+	if len(data) > activeNetParams.MaxDataCarrierSize {
+		return nil, fmt.Errorf("Data is %d bytes, the limit is %d", len(data), activeNetParams.MaxDataCarrierSize)
+	}
+
+	return NewScriptBuilder().AddOp(OP_RETURN).AddData(data).Script(), nil
+}
+
+// SignatureScript 创建P2PKH的解锁脚本 <sig> <pubKey>
+func SignatureScript(sig, pubKey []byte) Script {
+	return NewScriptBuilder().AddData(sig).AddData(pubKey).Script()
+}
+
+// GetScriptClass 判断锁定脚本属于哪一种标准模板
+func GetScriptClass(script Script) ScriptClass {
+	if ExtractPubKeyHash(script) != nil {
+		return PubKeyHashTy
+	}
+
+	if ExtractScriptHash(script) != nil {
+		return ScriptHashTy
+	}
+
+	if _, _, ok := ExtractMultiSig(script); ok {
+		return MultiSigTy
+	}
+
+	if _, ok := ExtractNullData(script); ok {
+		return NullDataTy
+	}
+
+	return NonStandardTy
+}
+
+// ExtractNullData 从OP_RETURN脚本里面取出携带的数据
+func ExtractNullData(script Script) ([]byte, bool) {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) == 0 || ops[0].op != OP_RETURN {
+		return nil, false
+	}
+
+	switch len(ops) {
+	case 1:
+		return []byte{}, true
+	case 2:
+		if isPushOp(ops[1].op) && ops[1].data != nil {
+			return ops[1].data, true
+		}
+	}
+
+	return nil, false
+}
+
+// ExtractPubKeyHash 从P2PKH锁定脚本里面取出公钥哈希, 其他类型的脚本返回nil
+func ExtractPubKeyHash(script Script) []byte {
+	if len(script) != 25 {
+		return nil
+	}
+
+	if script[0] == OP_DUP && script[1] == OP_HASH160 && script[2] == pubKeyHashLen &&
+		script[23] == OP_EQUALVERIFY && script[24] == OP_CHECKSIG {
+		return script[3:23]
+	}
+
+	return nil
+}
+
+// ExtractScriptHash 从P2SH锁定脚本里面取出赎回脚本的哈希, 其他类型的脚本返回nil
+func ExtractScriptHash(script Script) []byte {
+	if len(script) != 23 {
+		return nil
+	}
+
+	if script[0] == OP_HASH160 && script[1] == pubKeyHashLen && script[22] == OP_EQUAL {
+		return script[2:22]
+	}
+
+	return nil
+}
+
+// ExtractMultiSig 从多重签名脚本里面取出需要的签名数量和公钥列表
+func ExtractMultiSig(script Script) (int, [][]byte, bool) {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) < 4 {
+		return 0, nil, false
+	}
+
+	first, last := ops[0], ops[len(ops)-1]
+	numPubKeysOp := ops[len(ops)-2]
+	if !isSmallInt(first.op) || !isSmallInt(numPubKeysOp.op) || last.op != OP_CHECKMULTISIG {
+		return 0, nil, false
+	}
+
+	var pubKeys [][]byte
+	for _, pop := range ops[1 : len(ops)-2] {
+		if len(pop.data) == 0 {
+			return 0, nil, false
+		}
+		pubKeys = append(pubKeys, pop.data)
+	}
+
+	m := asSmallInt(first.op)
+	if asSmallInt(numPubKeysOp.op) != len(pubKeys) || m < 1 || m > len(pubKeys) {
+		return 0, nil, false
+	}
+
+	return m, pubKeys, true
+}
+
+// ExtractAddresses 返回锁定脚本对应的地址, 非标准脚本没有地址
+func ExtractAddresses(script Script) []string {
+	switch GetScriptClass(script) {
+	case PubKeyHashTy:
+		return []string{fmt.Sprintf("%s", PubKeyHashToAddress(ExtractPubKeyHash(script)))}
+	case ScriptHashTy:
+		return []string{fmt.Sprintf("%s", ScriptHashToAddress(ExtractScriptHash(script)))}
+	case MultiSigTy:
+		var addresses []string
+		_, pubKeys, _ := ExtractMultiSig(script)
+		for _, pubKey := range pubKeys {
+			addresses = append(addresses, fmt.Sprintf("%s", PubKeyHashToAddress(HashPubKey(pubKey))))
+		}
+		return addresses
+	}
+
+	return nil
+}
+
+// MultiSigSignatureScript 创建P2SH多重签名的解锁脚本 <sig1> ... <sigM> <redeemScript>
+func MultiSigSignatureScript(sigs [][]byte, redeemScript Script) Script {
+	builder := NewScriptBuilder()
+	for _, sig := range sigs {
+		builder.AddData(sig)
+	}
+
+	return builder.AddData(redeemScript).Script()
+}
+
+// isPayToPubKeyHash 锁定脚本是否是付给pubKeyHash的P2PKH脚本
+func isPayToPubKeyHash(script Script, pubKeyHash []byte) bool {
+	hash := ExtractPubKeyHash(script)
+	return hash != nil && bytes.Compare(hash, pubKeyHash) == 0
+}
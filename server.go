@@ -4,34 +4,62 @@ import (
 	"bytes"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
 const protocol = "tcp"
 const nodeVersion = 1
 const commandLength = 12
 
+// mempoolExpireInterval 检查交易池里面过期交易的间隔
+const mempoolExpireInterval = 10 * time.Minute
+
+// connectInterval 检查并重新连接断开的节点的间隔
+const connectInterval = 30 * time.Second
+
+// addrSaveInterval 定期保存地址簿的间隔
+const addrSaveInterval = 5 * time.Minute
+
 // 当前节点地址
 var nodeAddress string
 var miningAddress string
 
-// 已知的节点地址, 默认有一个3000是硬编码的中心地址
-var knownNodes = []string{"localhost:3000"}
-var blocksInTransit = [][]byte{}
-var mempool = make(map[string]Transaction)
+// localServices 本节点在version里面声明的服务, 运行节点时是nodeNetwork
+var localServices uint64
+
+// nodeConfig 启动时指定的节点, 见NodeConfig
+var nodeConfig NodeConfig
+
+// chainMutex 每个连接都在自己的goroutine里面处理消息, 修改链、UTXO集、交易池和区块同步状态的处理必须一个一个地进行.
+// 处理消息、挖矿和定期维护交易池之前都要先拿到这个锁
+var chainMutex sync.Mutex
 
 type verzion struct {
 	Version    int
 	BestHeight int
 	AddrFrom   string
+	// 发送方的本地时间, 用于计算网络调整时间
+	Timestamp int64
+	// Services 发送方提供的服务, 见nodeNetwork
+	Services uint64
 }
 
 type addr struct {
-	AddrList []string
+	AddrList []NetAddress
+}
+
+// getaddr 请求对方地址簿里面的地址
+type getaddr struct {
+	AddrFrom string
 }
 
 type getblocks struct {
@@ -60,6 +88,19 @@ type tx struct {
 	Transaction []byte
 }
 
+// reject 告诉对方它发过来的交易或者区块被拒绝了, 以及原因
+type reject struct {
+	AddrFrom string
+	Command  string
+	ID       []byte
+	Reason   string
+}
+
+// maxMessageSize 一条消息的payload最多可以有多少字节, 最大的消息是block
+func maxMessageSize() int {
+	return activeNetParams.MaxBlockSize + 1024
+}
+
 func commandToBytes(command string) []byte {
 	var bytes [commandLength]byte
 
@@ -82,12 +123,6 @@ func bytesToCommand(bytes []byte) string {
 	return fmt.Sprintf("%s", command)
 }
 
-func requestBlocks() {
-	for _, node := range knownNodes {
-		sendGetBlocks(node)
-	}
-}
-
 func gobEncode(data interface{}) []byte {
 	var buff bytes.Buffer
 
@@ -100,404 +135,846 @@ func gobEncode(data interface{}) []byte {
 	return buff.Bytes()
 }
 
-func nodeIsKnown(addr string) bool {
-	for _, node := range knownNodes {
-		if node == addr {
-			return true
-		}
-	}
-
-	return false
-}
-
 ///
 /// send func
 ///
 
-func sendData(addr string, data []byte) {
-	conn, err := net.Dial(protocol, addr)
-	if err != nil {
-		fmt.Printf("%s is not available\n", addr)
-		var updatedNodes []string
+// sendVersion 握手的第一条消息, 每个连接上双方各发送一次
+func sendVersion(peer *Peer, bc *Blockchain) {
+	data := verzion{nodeVersion, bc.GetBestHeight(), nodeAddress, time.Now().Unix(), localServices}
 
-		//把连接失败的那个节点从列表里面移除
-		for _, node := range knownNodes {
-			if node != addr {
-				updatedNodes = append(updatedNodes, node)
-			}
-		}
-
-		knownNodes = updatedNodes
+	err := peer.Send("version", gobEncode(data))
+	if err != nil {
+		log.Printf("Send version to %s failed: %s\n", peer.Addr(), err)
 		return
 	}
-	defer conn.Close()
+	fmt.Printf("[send to %s]: %#v\n\n", peer.Addr(), data)
+}
 
-	_, err = io.Copy(conn, bytes.NewReader(data))
+// sendVerack 确认收到了对方的version
+func sendVerack(peer *Peer) {
+	err := peer.Send("verack", []byte{})
 	if err != nil {
-		log.Panic(err)
+		log.Printf("Send verack to %s failed: %s\n", peer.Addr(), err)
 	}
 }
 
-func sendVersion(addr string, bc *Blockchain) {
-	bestHeight := bc.GetBestHeight()
-	payload := gobEncode(verzion{nodeVersion, bestHeight, nodeAddress})
-
-	request := append(commandToBytes("version"), payload...)
-
-	sendData(addr, request)
-	fmt.Printf("[send to %s]: %#v\n\n", addr, verzion{nodeVersion, bestHeight, nodeAddress})
+// sendAddr 在peer的连接上发送地址
+func sendAddr(peer *Peer, addrs []NetAddress) {
+	err := peer.Send("addr", gobEncode(addr{addrs}))
+	if err != nil {
+		log.Printf("Send addr to %s failed: %s\n", peer.Addr(), err)
+		return
+	}
+	fmt.Printf("[sendAddr to %s]: %d addresses\n\n", peer.Addr(), len(addrs))
 }
 
-func sendAddr(address string) {
-	nodes := addr{knownNodes}
-	nodes.AddrList = append(nodes.AddrList, nodeAddress)
-	payload := gobEncode(nodes)
-	request := append(commandToBytes("addr"), payload...)
-
-	sendData(address, request)
-	fmt.Printf("[send to %s]: %#v\n\n", address, nodes)
+// sendGetAddr 向peer请求它知道的地址
+func sendGetAddr(peer *Peer) {
+	err := peer.Send("getaddr", gobEncode(getaddr{nodeAddress}))
+	if err != nil {
+		log.Printf("Send getaddr to %s failed: %s\n", peer.Addr(), err)
+	}
 }
 
-func sendInv(address, kind string, items [][]byte) {
-	inventory := inv{nodeAddress, kind, items}
-	payload := gobEncode(inventory)
-	request := append(commandToBytes("inv"), payload...)
-
-	sendData(address, request)
-	fmt.Printf("[sendInv to %s]: nodeAddress:%s Type:%s items:\n", address, nodeAddress, kind)
-	for i, value := range inventory.Items {
-		fmt.Printf("%d:%x\n\n", i, value)
+// sendInvToPeer 直接在peer的连接上发送清单, 对方可能是连接过来的, 没有可以连接的监听地址
+func sendInvToPeer(peer *Peer, kind string, items [][]byte) {
+	err := peer.Send("inv", gobEncode(inv{nodeAddress, kind, items}))
+	if err != nil {
+		log.Printf("Send inv to %s failed: %s\n", peer.Addr(), err)
+		return
 	}
-
+	fmt.Printf("[sendInv to %s]: Type:%s items:%d\n\n", peer.Addr(), kind, len(items))
 }
 
-func sendGetBlocks(address string) {
-	payload := gobEncode(getblocks{nodeAddress})
-	request := append(commandToBytes("getblocks"), payload...)
-
-	sendData(address, request)
-	fmt.Printf("[send to %s]: %#v\n\n", address, getblocks{nodeAddress})
+// sendGetBlocks 向peer请求它的区块清单
+func sendGetBlocks(peer *Peer) {
+	err := peer.Send("getblocks", gobEncode(getblocks{nodeAddress}))
+	if err != nil {
+		log.Printf("Send getblocks to %s failed: %s\n", peer.Addr(), err)
+		return
+	}
+	fmt.Printf("[send to %s]: %#v\n\n", peer.Addr(), getblocks{nodeAddress})
 }
 
-func sendGetData(address, kind string, id []byte) {
-	payload := gobEncode(getdata{nodeAddress, kind, id})
-	request := append(commandToBytes("getdata"), payload...)
-
-	sendData(address, request)
+// sendGetData 在告诉我们这个交易或者区块的连接上请求它, 不能连接对方在消息里面自己填写的地址
+func sendGetData(peer *Peer, kind string, id []byte) {
+	err := peer.Send("getdata", gobEncode(getdata{nodeAddress, kind, id}))
+	if err != nil {
+		log.Printf("Send getdata to %s failed: %s\n", peer.Addr(), err)
+		return
+	}
 	if kind == "block" {
-		fmt.Printf("[sendGetData to %s]: sendGetData:%s, Type:%s, BlockHash:0x%x\n\n", address, nodeAddress, kind, id)
+		fmt.Printf("[sendGetData to %s]: sendGetData:%s, Type:%s, BlockHash:0x%x\n\n", peer.Addr(), nodeAddress, kind, id)
 	} else {
-		fmt.Printf("[sendGetData to %s]: sendGetData:%s, Type:%s, TxHash:0x%x\n\n", address, nodeAddress, kind, id)
+		fmt.Printf("[sendGetData to %s]: sendGetData:%s, Type:%s, TxHash:0x%x\n\n", peer.Addr(), nodeAddress, kind, id)
 	}
-
 }
 
-func sendBlock(addr string, b *Block) {
+// sendBlock 在请求区块的连接上回复区块
+func sendBlock(peer *Peer, b *Block) {
 	data := block{nodeAddress, b.Serialize()}
-	payload := gobEncode(data)
-	request := append(commandToBytes("block"), payload...)
-
-	sendData(addr, request)
-	fmt.Printf("[sendBlock to %s]: AddrFrom:%s, Hash:0x%x, Height:%d, Transactions:\n%s\n\n", addr, data.AddrFrom, b.Hash, b.Height, b.Transactions)
+	err := peer.Send("block", gobEncode(data))
+	if err != nil {
+		log.Printf("Send block to %s failed: %s\n", peer.Addr(), err)
+		return
+	}
+	fmt.Printf("[sendBlock to %s]: AddrFrom:%s, Hash:0x%x, Height:%d, Transactions:\n%s\n\n", peer.Addr(), data.AddrFrom, b.Hash, b.Height, b.Transactions)
 }
 
-func sendTx(addr string, tnx *Transaction) {
-	data := tx{nodeAddress, tnx.Serialize()}
-	payload := gobEncode(data)
-	request := append(commandToBytes("tx"), payload...)
+// sendTx 在请求交易的连接上回复交易
+func sendTx(peer *Peer, tnx *Transaction) {
+	err := peer.Send("tx", gobEncode(tx{nodeAddress, tnx.Serialize()}))
+	if err != nil {
+		log.Printf("Send tx to %s failed: %s\n", peer.Addr(), err)
+		return
+	}
+	fmt.Printf("[sendTx to %s]: AddFrom:%s, Transaction:%s\n\n", peer.Addr(), nodeAddress, tnx)
+}
 
-	sendData(addr, request)
-	fmt.Printf("[sendTx to %s]: AddFrom:%s, Transaction:%s \nRequest:%x\n\n", addr, nodeAddress, tnx, request)
-	fmt.Printf("tx:%x\n\n", tnx)
-	fmt.Printf("Serialize:%x\n\n", tnx.Serialize())
+// sendReject 在收到交易的连接上回复拒绝的原因. 命令行发送的交易没有监听地址, 只能通过原来的连接告诉它
+func sendReject(peer *Peer, command string, id []byte, reason string) {
+	err := peer.Send("reject", gobEncode(reject{nodeAddress, command, id, reason}))
+	if err != nil {
+		log.Printf("Send reject to %s failed: %s\n", peer.Addr(), err)
+		return
+	}
+	fmt.Printf("[sendReject to %s]: %s 0x%x: %s\n\n", peer.Addr(), command, id, reason)
 }
 
 ///
 ///handle func
 ///
-func handleConnection(conn net.Conn, bc *Blockchain) {
-	//读取所有数据, 直到结束标志, 这样意味着能每次都接受到对方发送过来的所有完整数据
-	request, err := ioutil.ReadAll(conn)
+// decodeFromPeer 解析peer发来的数据. 解析失败说明对方不遵守协议, 断开连接并返回false; 不能panic, 否则任何一个节点都可以让我们退出
+func decodeFromPeer(peer *Peer, data []byte, v interface{}) bool {
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(v)
 	if err != nil {
-		log.Panic(err)
+		log.Printf("Disconnect %s: malformed message: %s\n", peer.Addr(), err)
+		peers.Remove(peer)
+		return false
+	}
+
+	return true
+}
+
+// handleMessage 处理从peer收到的一条消息
+func handleMessage(peer *Peer, command string, payload []byte, bc *Blockchain) {
+	// 各个处理函数仍然按照 命令 + payload 的格式解析请求
+	request := append(commandToBytes(command), payload...)
+	fmt.Printf("Received %s command from %s\n\n", command, peer.Addr())
+
+	// 命令行的查询不需要握手, 其他消息必须在version之后
+	if command != "version" && !isRPCCommand(command) && !peer.VersionReceived() {
+		log.Printf("Disconnect %s: sent %s before version\n", peer.Addr(), command)
+		peers.Remove(peer)
+		return
+	}
+
+	// 命令行的查询只读取有自己的锁的状态, 挖矿的时候也可以回复
+	if !isRPCCommand(command) {
+		chainMutex.Lock()
+		defer chainMutex.Unlock()
 	}
-	command := bytesToCommand(request[:commandLength])
-	fmt.Printf("Received %s command\n\n", command)
 
 	switch command {
 	case "addr":
-		handleAddr(request)
+		handleAddr(peer, request)
+	case "getaddr":
+		handleGetAddr(peer)
 	case "block":
-		handleBlock(request, bc)
+		handleBlock(peer, request, bc)
 	case "inv":
-		handleInv(request, bc)
+		handleInv(peer, request, bc)
 	case "getblocks":
-		handleGetBlocks(request, bc)
+		handleGetBlocks(peer, request, bc)
 	case "getdata":
-		handleGetData(request, bc)
+		handleGetData(peer, request, bc)
 	case "tx":
-		fmt.Printf("Receive request:%x\n\n", request)
-		handleTx(request, bc)
+		handleTx(peer, request, bc)
 	case "version":
-		handleVersion(request, bc)
+		handleVersion(peer, request, bc)
+	case "verack":
+		handleVerack(peer)
+	case "reject":
+		handleReject(peer, request)
+	case "mempoolinfo":
+		handleMempoolInfo(peer)
+	case "getpeerinfo":
+		handleGetPeerInfo(peer)
 	default:
 		fmt.Println("Unknown command!")
 	}
-
-	conn.Close()
 }
 
-func handleVersion(request []byte, bc *Blockchain) {
-	var buff bytes.Buffer
+// handleVersion 记录对方的版本、高度和服务, 回复verack. 被连接的一方同时发送自己的version, 高度低的一方向对方请求区块
+func handleVersion(peer *Peer, request []byte, bc *Blockchain) {
 	var payload verzion
+	if !decodeFromPeer(peer, request[commandLength:], &payload) {
+		return
+	}
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+	if !peer.recordVersion(payload) {
+		log.Printf("Ignore duplicate version from %s\n", peer.Addr())
+		return
+	}
+
+	if peer.inbound {
+		sendVersion(peer, bc)
 	}
+	sendVerack(peer)
+
+	// 命令行发送交易的连接不是节点, 不能向它请求区块或者转发消息
+	if payload.Services&nodeNetwork == 0 {
+		return
+	}
+
+	// 时间样本按连接的IP记录, 对方自己填写的地址可以随便改, 同一台机器也不能重新连接多次投票
+	timeSource.AddTimeSample(peer.Host(), payload.Timestamp)
 
 	myBestHeight := bc.GetBestHeight()
 	foreignerBestHeight := payload.BestHeight
 
 	if myBestHeight < foreignerBestHeight {
-		sendGetBlocks(payload.AddrFrom)
-	} else if myBestHeight > foreignerBestHeight {
-		sendVersion(payload.AddrFrom, bc)
+		sendGetBlocks(peer)
 	}
 
-	if !nodeIsKnown(payload.AddrFrom) {
-		knownNodes = append(knownNodes, payload.AddrFrom)
+	// 主动连接成功说明地址是可以连接的; 连接过来的节点告诉了我们它的监听地址, 先记下来
+	if peer.inbound {
+		addrManager.Add([]NetAddress{{payload.AddrFrom, time.Now().Unix(), payload.Services}}, peer.Addr())
+	} else {
+		addrManager.Good(peer.Addr(), payload.Services)
+		sendGetAddr(peer)
 	}
+	// 告诉对方我们自己的地址, 它会转发给其他节点
+	sendAddr(peer, []NetAddress{{nodeAddress, time.Now().Unix(), localServices}})
 }
 
-func handleGetBlocks(request []byte, bc *Blockchain) {
-	var buff bytes.Buffer
-	var payload getblocks
+// handleVerack 对方确认了我们的version, 握手完成
+func handleVerack(peer *Peer) {
+	peer.recordVerack()
+	fmt.Printf("Handshake with %s is done\n", peer.Addr())
+}
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+func handleGetBlocks(peer *Peer, request []byte, bc *Blockchain) {
+	var payload getblocks
+	if !decodeFromPeer(peer, request[commandLength:], &payload) {
+		return
 	}
 
 	// 顺序是从新块到旧块
 	blocks := bc.GetBlockHashes()
-	sendInv(payload.AddrFrom, "block", blocks)
+	sendInvToPeer(peer, "block", blocks)
 }
 
 // handleInv inventory 处理接收到的目录清单
-func handleInv(request []byte, bc *Blockchain) {
-	var buff bytes.Buffer
+func handleInv(peer *Peer, request []byte, bc *Blockchain) {
 	var payload inv
-
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+	if !decodeFromPeer(peer, request[commandLength:], &payload) {
+		return
 	}
 
 	fmt.Printf("Recevied inventory with %d %s\n", len(payload.Items), payload.Type)
+	for _, item := range payload.Items {
+		peer.AddKnownInventory(item)
+	}
 
 	if payload.Type == "block" {
-		blocksInTransit = payload.Items
-
-		blockHash := payload.Items[0]
-		sendGetData(payload.AddrFrom, "block", blockHash)
-
+		// 清单的顺序是从新块到旧块, 这里倒过来从旧块开始请求, 这样收到区块的时候它的父块已经在本地了, 才能验证
 		newInTransit := [][]byte{}
-		for _, b := range blocksInTransit {
-			if bytes.Compare(b, blockHash) != 0 {
-				newInTransit = append(newInTransit, b)
+		for i := len(payload.Items) - 1; i >= 0; i-- {
+			if _, err := bc.GetBlock(payload.Items[i]); err != nil && !orphanBlocks.Has(payload.Items[i]) {
+				newInTransit = append(newInTransit, payload.Items[i])
 			}
 		}
-		blocksInTransit = newInTransit
+
+		if len(newInTransit) == 0 {
+			return
+		}
+
+		blockHash := newInTransit[0]
+		sendGetData(peer, "block", blockHash)
+
+		// 每个连接有自己的同步列表, 另一个节点发来的清单不会打断和这个节点的同步
+		peer.blocksInTransit = newInTransit[1:]
 	}
 
-	if payload.Type == "tx" {
+	if payload.Type == "tx" && len(payload.Items) > 0 {
 		txID := payload.Items[0]
 
-		if mempool[hex.EncodeToString(txID)].ID == nil {
-			sendGetData(payload.AddrFrom, "tx", txID)
+		if id := hex.EncodeToString(txID); !mempool.Has(id) && !orphanPool.Has(id) {
+			sendGetData(peer, "tx", txID)
 		}
 	}
 }
 
-func handleGetData(request []byte, bc *Blockchain) {
-	var buff bytes.Buffer
+func handleGetData(peer *Peer, request []byte, bc *Blockchain) {
 	var payload getdata
-
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		panic(err)
+	if !decodeFromPeer(peer, request[commandLength:], &payload) {
+		return
 	}
 
 	if payload.Type == "block" {
 		block, err := bc.GetBlock([]byte(payload.ID))
 		if err != nil {
-			panic(err)
+			// 我们只通知过自己有的区块, 请求不存在的区块的节点不遵守协议
+			log.Printf("Disconnect %s: requested unknown block 0x%x\n", peer.Addr(), payload.ID)
+			peers.Remove(peer)
+			return
 		}
 
-		sendBlock(payload.AddrFrom, &block)
+		sendBlock(peer, &block)
 	}
 
 	if payload.Type == "tx" {
 		txID := hex.EncodeToString(payload.ID)
-		tx := mempool[txID]
+		tx, ok := mempool.Get(txID)
+		if !ok {
+			log.Printf("Tx 0x%s requested by %s is not in the mempool\n", txID, peer.Addr())
+			return
+		}
 
-		sendTx(payload.AddrFrom, &tx)
+		sendTx(peer, &tx)
 	}
 }
 
-func handleBlock(request []byte, bc *Blockchain) {
-	var buff bytes.Buffer
+func handleBlock(peer *Peer, request []byte, bc *Blockchain) {
 	var payload block
+	if !decodeFromPeer(peer, request[commandLength:], &payload) {
+		return
+	}
+
+	block := &Block{}
+	if !decodeFromPeer(peer, payload.Block, block) {
+		return
+	}
+	peer.AddKnownInventory(block.Hash)
+
+	fmt.Println("Recevied a new block!")
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
+	// 父块还没有到达时先保存起来, 向对方请求缺少的祖先, 等父块连接到链上之后再连接它
+	if _, err := bc.GetBlock(block.PrevBlockHash); err != nil && len(block.PrevBlockHash) > 0 {
+		// 工作量证明不依赖父块, 先检查它, 伪造的区块不能进入孤儿区块池
+		err := checkProofOfWork(block)
+		if err == nil {
+			err = orphanBlocks.Add(block, peer)
+		}
+		if err != nil {
+			log.Printf("Reject orphan block 0x%x: %s\n", block.Hash, err)
+			return
+		}
+		missing := orphanBlocks.MissingAncestor(block.Hash)
+		if missing == nil {
+			return
+		}
+		log.Printf("Block 0x%x is an orphan, missing ancestor 0x%x\n", block.Hash, missing)
+
+		inTransit := false
+		for _, hash := range peer.blocksInTransit {
+			if bytes.Compare(hash, missing) == 0 {
+				inTransit = true
+			}
+		}
+		if !inTransit {
+			sendGetData(peer, "block", missing)
+		}
+		return
+	}
+
+	oldTip := bc.tip
+	err := connectBlock(block, bc)
 	if err != nil {
-		log.Panic(err)
+		log.Printf("Reject block 0x%x: %s\n", block.Hash, err)
+		peer.blocksInTransit = nil
+		return
 	}
+	connectOrphanBlocks(block.Hash, bc)
 
-	blockData := payload.Block
-	block := DeserializeBlock(blockData)
+	// 同步完成之后, 链有了新的最高区块就通知其他节点, 缺少中间区块的节点会按照孤儿区块的方式向我们请求
+	if len(peer.blocksInTransit) == 0 && bytes.Compare(oldTip, bc.tip) != 0 {
+		relayInventory("block", bc.tip)
+	}
 
-	fmt.Println("Recevied a new block!")
+	if len(peer.blocksInTransit) > 0 {
+		blockHash := peer.blocksInTransit[0]
+		sendGetData(peer, "block", blockHash)
+
+		peer.blocksInTransit = peer.blocksInTransit[1:]
+	}
+}
+
+// connectBlock 验证区块并把它加入到链上, 区块的父块必须已经在链上
+func connectBlock(block *Block, bc *Blockchain) error {
+	if _, err := bc.GetBlock(block.Hash); err != nil {
+		err = bc.ValidateBlock(block, bc.AssumeValid(block))
+		if err != nil {
+			return err
+		}
+	}
+	oldTip := bc.tip
 	bc.AddBlock(block)
 
 	fmt.Printf("Added block %x\n", block.Hash)
+	// 每个区块连接之后都要更新UTXO集, 下一个区块的输入要用它检查. 新的最高区块在另一条分叉上时重新计算
+	if bytes.Compare(oldTip, bc.tip) != 0 {
+		UTXOSet := UTXOSet{bc}
+		if bytes.Compare(block.PrevBlockHash, oldTip) == 0 {
+			UTXOSet.Update(block)
+		} else {
+			UTXOSet.Reindex()
+		}
+		removeBlockFromMempool(block)
+	}
 
-	if len(blocksInTransit) > 0 {
-		blockHash := blocksInTransit[0]
-		sendGetData(payload.AddrFrom, "block", blockHash)
+	return nil
+}
 
-		blocksInTransit = blocksInTransit[1:]
-	} else {
-		UTXOSet := UTXOSet{bc}
-		// 这里应该只需要更新UTXO即可,不用从头到尾都更新. 但是这个demo的区块更新顺序是从高到低, 所以如果要优化成更新UTXO的话,需要修改很多代码😂
-		UTXOSet.Reindex()
+// connectOrphanBlocks 区块hash连接到链上之后, 按顺序连接等待它的孤儿区块, 以及孤儿区块的后代
+func connectOrphanBlocks(hash []byte, bc *Blockchain) {
+	queue := [][]byte{hash}
+
+	for len(queue) > 0 {
+		parent := queue[0]
+		queue = queue[1:]
+
+		for _, orphan := range orphanBlocks.TakeChildren(parent) {
+			err := connectBlock(orphan.Block, bc)
+			if err != nil {
+				log.Printf("Reject orphan block 0x%x from %s: %s\n", orphan.Block.Hash, orphan.From.Addr(), err)
+				continue
+			}
+			queue = append(queue, orphan.Block.Hash)
+		}
 	}
 }
 
-// handleTx 矿工节点需要用到
-func handleTx(request []byte, bc *Blockchain) {
-	var buff bytes.Buffer
+// handleTx 验证收到的交易, 进入交易池之后转发给其他节点, 矿工节点还会打包交易
+func handleTx(peer *Peer, request []byte, bc *Blockchain) {
 	var payload tx
-
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+	if !decodeFromPeer(peer, request[commandLength:], &payload) {
+		return
 	}
 
 	txData := payload.Transaction
 	// 接收到的tx是已经签名过的
-	tx := DeserializeTransaction(txData)
-	// 这里接受到的txData和钱包节点发送过来的字节不同. 具体原因暂时不清楚(有可能是中心节点把tx加进"tx"结构体导致的), 有几个字节是不同的, 会导致后面在验证tx的时候,出现验证错误.
-	// 使用fmt.Sprintf("%x", tx)这种方法, 直接把tx结构体打印成二进制出来, 则没有这种问题了.
-	fmt.Printf("Receive txStruct:%s\n\n", tx)
-	fmt.Printf("Receive txData:%x\n\n", txData)
-	fmt.Printf("Receive tx:%x\n\n", tx)
-
-	mempool[hex.EncodeToString(tx.ID)] = tx
-
-	//中心节点收到消息时执行:
-	if nodeAddress == knownNodes[0] {
-		for _, node := range knownNodes {
-			if node != nodeAddress && node != payload.AddFrom {
-				sendInv(node, "tx", [][]byte{tx.ID})
+	var tx Transaction
+	if !decodeFromPeer(peer, txData, &tx) {
+		return
+	}
+	peer.AddKnownInventory(tx.ID)
+	expireMempool()
+	if !acceptTransaction(&tx, peer, bc) {
+		return
+	}
+	relayInventory("tx", tx.ID)
+
+	//矿工节点打包交易池里面的交易:
+	if mempool.Count() >= 2 && len(miningAddress) > 0 && !mining {
+		mineTransactions(bc)
+	}
+}
+
+// mining 是否正在挖矿, 挖矿的时候会释放chainMutex, 其他连接收到交易时不能再同时开始挖矿. 由chainMutex保护
+var mining bool
+
+// mineTransactions 把交易池里面的交易打包成区块, 直到交易池里面没有可以打包的交易
+// 调用者必须持有chainMutex, 计算工作量证明的时候释放它, 其他连接的消息可以继续处理
+func mineTransactions(bc *Blockchain) {
+	mining = true
+	defer func() { mining = false }()
+
+	for mempool.Count() > 0 {
+		var candidates []*Transaction
+		fees := make(map[string]int)
+
+		for _, desc := range mempool.Descs() {
+			id := hex.EncodeToString(desc.Tx.ID)
+			tx := desc.Tx
+			if checkMempoolLocks(&tx, bc) != nil {
+				// 还没有解锁的交易留在池里面
+				continue
 			}
-		}
-	} else {
-		//矿工点收到消息时执行:
-		if len(mempool) >= 2 && len(miningAddress) > 0 {
-		MineTransactions:
-			var txs []*Transaction
-
-			for id := range mempool {
-				tx := mempool[id]
-				if bc.VerifyTransaction(&tx) {
-					txs = append(txs, &tx)
-				} else {
-					//无效的交易必须从池中移除
-					log.Printf("delete invalid tx: 0x%s\n\n", id)
-					delete(mempool, id)
-				}
+			if fee, err := checkMempoolTransaction(&tx, bc); err == nil {
+				candidates = append(candidates, &tx)
+				fees[id] = fee
+			} else {
+				//无效的交易必须从池中移除
+				log.Printf("delete invalid tx: 0x%s: %s\n\n", id, err)
+				mempool.Remove(id)
 			}
+		}
 
-			if len(txs) == 0 {
-				fmt.Println("All transactions are invalid! Waiting for new ones...")
-				return
-			}
+		// 父交易不能打包时, 子交易也不能打包
+		candidates = withAncestors(candidates, fees)
 
-			cbTx := NewCoinbaseTX(miningAddress, "")
-			txs = append(txs, cbTx)
+		if len(candidates) == 0 {
+			fmt.Println("All transactions are invalid! Waiting for new ones...")
+			return
+		}
 
-			newBlock := bc.MineBlock(txs)
-			UTXOSet := UTXOSet{bc}
-			UTXOSet.Reindex()
+		// 放不下的交易留在池里面, 下一个区块再打包. 一个交易也放不下时不挖只有coinbase的区块
+		txs := NewBlockTemplate(candidates, fees, miningAddress)
+		if len(txs) == 1 {
+			return
+		}
 
-			fmt.Println("New block is mined!")
+		newBlock, err := bc.PrepareBlock(txs)
+		if err != nil {
+			log.Printf("Failed to mine block: %s\n", err)
+			return
+		}
 
-			for _, tx := range txs {
-				txID := hex.EncodeToString(tx.ID)
-				delete(mempool, txID)
-			}
+		chainMutex.Unlock()
+		newBlock.Mine()
+		chainMutex.Lock()
+
+		// 挖矿的时候其他连接可能已经连接了新的区块, 这个区块的父块不再是最高区块, 重新打包
+		if bytes.Compare(newBlock.PrevBlockHash, bc.tip) != 0 {
+			log.Printf("Tip changed while mining, discard block 0x%x\n", newBlock.Hash)
+			continue
+		}
+		bc.AddBlock(newBlock)
+		UTXOSet := UTXOSet{bc}
+		UTXOSet.Update(newBlock)
+
+		fmt.Println("New block is mined!")
+
+		removeBlockFromMempool(newBlock)
+
+		relayInventory("block", newBlock.Hash)
+	}
+}
+
+// acceptTransaction 验证从连接from收到的交易并加入交易池, 返回tx是否进入了交易池
+// 缺少父交易时把tx放进孤儿交易池, 并在from上请求父交易; tx进入交易池之后, 等待它的孤儿交易会被重新处理
+func acceptTransaction(tx *Transaction, from *Peer, bc *Blockchain) bool {
+	// 孤儿交易池和交易池都用交易id作为key, 所以先检查id
+	if err := CheckTransactionID(tx); err != nil {
+		log.Printf("Reject tx 0x%x: %s\n", tx.ID, err)
+		sendReject(from, "tx", tx.ID, err.Error())
+		return false
+	}
+
+	// 多个节点都会转发同一个交易, 已经有的直接忽略
+	if id := hex.EncodeToString(tx.ID); mempool.Has(id) || orphanPool.Has(id) {
+		return false
+	}
 
-			for _, node := range knownNodes {
-				if node != nodeAddress {
-					sendInv(node, "block", [][]byte{newBlock.Hash})
-				}
+	if missing := missingParents(tx, bc); len(missing) > 0 {
+		err := orphanPool.Add(tx, from)
+		if err != nil {
+			log.Printf("Reject tx 0x%x: %s\n", tx.ID, err)
+			sendReject(from, "tx", tx.ID, err.Error())
+			return false
+		}
+
+		log.Printf("Tx 0x%x is an orphan, missing %d parents\n", tx.ID, len(missing))
+		for _, parent := range missing {
+			if !orphanPool.Has(hex.EncodeToString(parent)) {
+				sendGetData(from, "tx", parent)
 			}
+		}
+		return false
+	}
+
+	fee, err := checkMempoolTransaction(tx, bc)
+	if err != nil {
+		log.Printf("Reject tx 0x%x: %s\n", tx.ID, err)
+		sendReject(from, "tx", tx.ID, err.Error())
+		return false
+	}
+	// 和交易池里面的交易冲突时, 只有满足replace-by-fee的条件才能替换掉它们
+	replaced, err := checkReplacement(tx, fee)
+	if err == nil {
+		err = mempool.Add(tx, fee, replaced)
+	}
+	if err != nil {
+		log.Printf("Reject tx 0x%x: %s\n", tx.ID, err)
+		sendReject(from, "tx", tx.ID, err.Error())
+		return false
+	}
+	for _, id := range replaced {
+		log.Printf("Tx 0x%s is replaced by 0x%x\n", id, tx.ID)
+	}
+
+	processOrphans(tx.ID, bc)
+	return true
+}
+
+// processOrphans 父交易parentID进入交易池之后, 重新处理等待它的孤儿交易, 被接受的孤儿交易也会继续带出它们的子交易
+func processOrphans(parentID []byte, bc *Blockchain) {
+	for _, orphan := range orphanPool.TakeChildren(hex.EncodeToString(parentID)) {
+		tx := orphan.Tx
+		log.Printf("Reprocess orphan tx 0x%x\n", tx.ID)
+		if acceptTransaction(&tx, orphan.From, bc) {
+			relayInventory("tx", tx.ID)
+		}
+	}
+}
+
+// relayInventory 把新的交易或者区块通知给所有还没有它的节点, 发给我们的节点已经有了, 不会再通知它
+func relayInventory(kind string, id []byte) {
+	for _, peer := range peers.Peers() {
+		if !peer.IsNode() || peer.HasInventory(id) {
+			continue
+		}
+
+		peer.AddKnownInventory(id)
+		sendInvToPeer(peer, kind, [][]byte{id})
+	}
+}
+
+// checkMempoolTransaction 检查交易能否进入交易池, 包括共识规则和本节点的转发规则(activePolicy), 返回手续费
+func checkMempoolTransaction(tx *Transaction, bc *Blockchain) (int, error) {
+	if tx.IsCoinbase() {
+		return 0, errors.New("coinbase: a coinbase transaction can not be relayed")
+	}
+
+	err := CheckTransactionSize(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	err = CheckTransactionID(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	// 可以花费交易池里面还没有确认的交易的输出
+	prevTXs, err := mempool.PrevTransactions(tx, bc)
+	if err != nil {
+		return 0, err
+	}
+
+	// 链上的输入必须还没有被花费, 和交易池里面的交易的冲突由Mempool.Add检查
+	UTXOSet := UTXOSet{bc}
+	for _, vin := range tx.Vin {
+		if mempool.Has(hex.EncodeToString(vin.Txid)) {
+			continue
+		}
+		if _, ok := UTXOSet.FindCoin(Outpoint{vin.Txid, vin.Vout}); !ok {
+			return 0, fmt.Errorf("bad-txns-inputs-missingorspent: output %x:%d", vin.Txid, vin.Vout)
+		}
+	}
+
+	fee, err := CheckTransactionInputs(tx, prevTXs)
+	if err != nil {
+		return 0, err
+	}
+
+	err = activePolicy.CheckTransactionStandard(tx, fee)
+	if err != nil {
+		return 0, err
+	}
+
+	// 时间锁还没有解锁的交易不能进入交易池
+	err = checkMempoolLocks(tx, bc)
+	if err != nil {
+		return 0, err
+	}
 
-			if len(mempool) > 0 {
-				goto MineTransactions
+	if !tx.Verify(prevTXs) {
+		return 0, errors.New("Invalid transaction signature")
+	}
+
+	return fee, nil
+}
+
+// checkMempoolLocks 检查交易的时间锁在下一个区块里面是否已经解锁, 交易池里面的交易当作在下一个区块确认
+func checkMempoolLocks(tx *Transaction, bc *Blockchain) error {
+	pending := make(map[string]bool)
+	for _, id := range mempool.TxIDs() {
+		pending[id] = true
+	}
+
+	return bc.CheckTransactionLocks(tx, bc.GetBestHeight()+1, bc.CalcPastMedianTime(bc.tip), pending)
+}
+
+// expireMempool 移除在交易池里面停留太久的交易
+func expireMempool() {
+	for _, id := range mempool.Expire(time.Now()) {
+		log.Printf("Tx 0x%s expired, removed from mempool\n", id)
+	}
+}
+
+// mempoolMaintenance 定期清理过期的交易, 以及保存交易池, 防止节点异常退出时丢失
+func mempoolMaintenance(nodeID string) {
+	expireTicker := time.NewTicker(mempoolExpireInterval)
+	saveTicker := time.NewTicker(mempoolSaveInterval)
+
+	for {
+		select {
+		case <-expireTicker.C:
+			chainMutex.Lock()
+			expireMempool()
+			if expired := orphanPool.Expire(time.Now()); expired > 0 {
+				log.Printf("%d orphan transactions expired\n", expired)
 			}
+			chainMutex.Unlock()
+		case <-saveTicker.C:
+			chainMutex.Lock()
+			mempool.SaveToFile(nodeID)
+			chainMutex.Unlock()
 		}
 	}
 }
 
-func handleAddr(request []byte) {
-	var buff bytes.Buffer
+// removeBlockFromMempool 区块连接到链上之后, 从交易池移除已经确认的交易以及和它们冲突的交易
+func removeBlockFromMempool(block *Block) {
+	for _, id := range mempool.RemoveBlock(block) {
+		log.Printf("Tx 0x%s conflicts with block 0x%x, removed from mempool\n", id, block.Hash)
+	}
+}
+
+// handleAddr 把收到的地址加入地址簿. 少量新鲜的新地址继续转发给几个随机的节点, 这样新节点的地址可以传遍整个网络
+func handleAddr(peer *Peer, request []byte) {
 	var payload addr
+	if !decodeFromPeer(peer, request[commandLength:], &payload) {
+		return
+	}
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+	if len(payload.AddrList) > maxAddrPerMessage {
+		log.Printf("Disconnect %s: addr message with %d addresses\n", peer.Addr(), len(payload.AddrList))
+		peers.Remove(peer)
+		return
+	}
+
+	added := addrManager.Add(payload.AddrList, peer.Addr())
+	fmt.Printf("Received %d addresses from %s, %d are new, %d known addresses now\n", len(payload.AddrList), peer.Addr(), len(added), addrManager.Count())
+
+	// 很多地址的addr是对getaddr的回复, 不转发
+	if len(payload.AddrList) > addrRelayMaxCount {
+		return
+	}
+
+	var fresh []NetAddress
+	for _, na := range added {
+		if time.Since(time.Unix(na.Timestamp, 0)) <= addrRelayMaxAge {
+			fresh = append(fresh, na)
+		}
+	}
+	if len(fresh) > 0 {
+		relayAddr(fresh, peer)
+	}
+}
+
+// relayAddr 把新地址转发给最多addrRelayPeers个随机的节点, 不包括告诉我们这些地址的from
+func relayAddr(addrs []NetAddress, from *Peer) {
+	var targets []*Peer
+	for _, peer := range peers.Peers() {
+		if peer != from && peer.IsNode() {
+			targets = append(targets, peer)
+		}
 	}
 
-	knownNodes = append(knownNodes, payload.AddrList...)
-	fmt.Printf("There are %d known nodes now!\n", len(knownNodes))
-	requestBlocks()
+	rand.Shuffle(len(targets), func(i, j int) {
+		targets[i], targets[j] = targets[j], targets[i]
+	})
+	if len(targets) > addrRelayPeers {
+		targets = targets[:addrRelayPeers]
+	}
+
+	for _, peer := range targets {
+		sendAddr(peer, addrs)
+	}
+}
+
+// handleGetAddr 回复地址簿里面随机的一部分地址
+func handleGetAddr(peer *Peer) {
+	sendAddr(peer, addrManager.Sample(maxGetAddrReply))
+}
+
+func handleReject(peer *Peer, request []byte) {
+	var payload reject
+	if !decodeFromPeer(peer, request[commandLength:], &payload) {
+		return
+	}
+
+	log.Printf("%s rejected %s 0x%x: %s\n", payload.AddrFrom, payload.Command, payload.ID, payload.Reason)
+}
+
+// maintainConnections 定期连接还没有连上的节点, 并保存地址簿.
+// 先连接-connect或者-addnode指定的节点; 没有使用-connect时, 剩下的主动连接位置从地址簿里面选择.
+// 没有中心节点, 任何一个节点下线之后, 其他节点仍然通过别的连接转发交易和区块, 它恢复之后会被重新连上
+func maintainConnections(nodeID string) {
+	lastSave := time.Now()
+
+	for {
+		configured := nodeConfig.Connect
+		if len(configured) == 0 {
+			configured = nodeConfig.AddNode
+		}
+		for _, addr := range configured {
+			_, err := peers.Connect(addr)
+			if err == errOutboundFull {
+				break
+			}
+			if err != nil {
+				log.Printf("Connect to %s failed: %s\n", addr, err)
+			}
+		}
+
+		// 每次最多尝试maxOutboundPeers个地址, 连接失败的地址在addrRetryInterval之内不会再被选中
+		for i := 0; len(nodeConfig.Connect) == 0 && i < maxOutboundPeers && peers.OutboundCount() < maxOutboundPeers; i++ {
+			addr := addrManager.Select(peers.Connected)
+			if addr == "" {
+				break
+			}
+
+			addrManager.Attempt(addr)
+			_, err := peers.Connect(addr)
+			if err != nil {
+				log.Printf("Connect to %s failed: %s\n", addr, err)
+			}
+		}
+
+		if time.Since(lastSave) >= addrSaveInterval {
+			addrManager.SaveToFile(nodeID)
+			lastSave = time.Now()
+		}
+
+		time.Sleep(connectInterval)
+	}
 }
 
 // StartServer  启动服务
 // minerAddress 参数指定了接收挖矿奖励的地址
-func StartServer(nodeID, minerAddress string) {
-	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
+// config 指定监听和告诉其他节点的地址, 以及启动时连接的节点
+func StartServer(nodeID, minerAddress string, config NodeConfig) {
+	nodeAddress = config.ExternalAddress()
 	miningAddress = minerAddress
-	ln, err := net.Listen(protocol, nodeAddress)
+	localServices = nodeNetwork
+	nodeConfig = config
+	if ip := net.ParseIP(config.Listen); ip != nil && ip.IsLoopback() {
+		dialLocalIP = ip
+	}
+	ln, err := net.Listen(protocol, config.ListenAddress())
 	if err != nil {
 		log.Panic(err)
 	}
+	fmt.Printf("Listening on %s, advertising %s\n", ln.Addr(), nodeAddress)
 
 	defer ln.Close()
 
 	bc := NewBlockchain(nodeID)
-
-	//非中心节点的程序, 向中心节点发起版本信息
-	if nodeAddress != knownNodes[0] {
-		sendVersion(knownNodes[0], bc)
-	}
+	peers.bc = bc
+
+	fmt.Printf("Loaded %d transactions into the mempool\n", loadMempool(nodeID, bc))
+	fmt.Printf("Loaded %d addresses into the address book\n", addrManager.LoadFromFile(nodeID))
+	go mempoolMaintenance(nodeID)
+
+	// Ctrl-C 退出之前保存交易池
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		mempool.SaveToFile(nodeID)
+		addrManager.SaveToFile(nodeID)
+		fmt.Printf("Saved %d mempool transactions and %d addresses, shutting down\n", mempool.Count(), addrManager.Count())
+		os.Exit(0)
+	}()
+
+	// 连接建立之后会自动发送版本信息
+	go maintainConnections(nodeID)
 
 	for {
 		conn, err := ln.Accept()
@@ -505,6 +982,6 @@ func StartServer(nodeID, minerAddress string) {
 			log.Panic(err)
 		}
 
-		go handleConnection(conn, bc)
+		peers.Accept(conn)
 	}
 }
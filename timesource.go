@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 最多记录多少个节点的时间偏移
+const maxTimeSamples = 200
+
+// 网络时间和本地时间相差超过这个值(秒)就不再调整, 说明本地时钟或者其他节点有问题
+const maxTimeAdjustment = 70 * 60
+
+// MedianTimeSource 根据其他节点在version消息里面报告的时间, 计算出网络调整后的时间
+type MedianTimeSource struct {
+	mutex   sync.Mutex
+	offsets map[string]int64
+	offset  int64
+}
+
+var timeSource = NewMedianTimeSource()
+
+// NewMedianTimeSource 创建一个还没有任何样本的时间源
+func NewMedianTimeSource() *MedianTimeSource {
+	return &MedianTimeSource{offsets: make(map[string]int64)}
+}
+
+// AddTimeSample 记录IP是host的节点报告的时间, 每个IP只记录一次
+func (ts *MedianTimeSource) AddTimeSample(host string, timestamp int64) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	if _, ok := ts.offsets[host]; ok || len(ts.offsets) >= maxTimeSamples {
+		return
+	}
+	ts.offsets[host] = timestamp - time.Now().Unix()
+
+	// 和比特币一样, 样本数量是奇数的时候才更新偏移
+	if len(ts.offsets)%2 == 0 {
+		return
+	}
+
+	var offsets []int64
+	for _, offset := range ts.offsets {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	median := offsets[len(offsets)/2]
+	if median > maxTimeAdjustment || median < -maxTimeAdjustment {
+		log.Printf("Median time offset %ds is too large, please check your clock\n", median)
+		ts.offset = 0
+		return
+	}
+
+	ts.offset = median
+}
+
+// Offset 返回当前使用的时间偏移(秒)
+func (ts *MedianTimeSource) Offset() int64 {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	return ts.offset
+}
+
+// AdjustedTime 返回网络调整后的当前时间
+func (ts *MedianTimeSource) AdjustedTime() int64 {
+	return time.Now().Unix() + ts.Offset()
+}
@@ -3,14 +3,13 @@ package main
 import (
 	"bytes"
 	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/gob"
 	"encoding/hex"
 	"fmt"
 	"log"
-	"math/big"
 	"strings"
 )
 
@@ -20,12 +19,14 @@ type Transaction struct {
 	ID   []byte
 	Vin  []TXInput
 	Vout []TXOutput
+	// LockTime 交易生效的区块高度或者unix时间, 0表示立即生效, 参考IsFinal
+	LockTime uint32
 }
 
 type TXOutput struct {
 	Value int
-	//ScriptPubKey string
-	PubKeyHash []byte
+	// ScriptPubKey 锁定脚本, 标准的是P2PKH, 参考PayToPubKeyHashScript
+	ScriptPubKey Script
 }
 
 // NewTXOutput create a new TXOutput
@@ -36,13 +37,23 @@ func NewTXOutput(value int, address string) *TXOutput {
 	return txo
 }
 
+// Lock 用地址对应的P2PKH脚本锁定输出
 func (out *TXOutput) Lock(address []byte) {
-	pubKeyHash := HashPubKeyFromAddress(address)
-	out.PubKeyHash = pubKeyHash
+	script, err := PayToAddrScript(string(address))
+	if err != nil {
+		log.Panic(err)
+	}
+	out.ScriptPubKey = script
 }
 
+// IsLockedWithKey 输出是否是付给pubKeyHash的P2PKH输出
 func (out *TXOutput) IsLockedWithKey(pubKeyHash []byte) bool {
-	return bytes.Compare(out.PubKeyHash, pubKeyHash) == 0
+	return isPayToPubKeyHash(out.ScriptPubKey, pubKeyHash)
+}
+
+// IsLockedWithScript 输出的锁定脚本是否就是lockingScript
+func (out *TXOutput) IsLockedWithScript(lockingScript Script) bool {
+	return bytes.Compare(out.ScriptPubKey, lockingScript) == 0
 }
 
 // String returns a human-readable representation of a TXOutput
@@ -52,14 +63,15 @@ func (output TXOutput) String() string {
 	lines = append(lines, fmt.Sprintf("\n--- TXOutput"))
 
 	lines = append(lines, fmt.Sprintf("       Value:  %d", output.Value))
-	lines = append(lines, fmt.Sprintf("       PubKeyHash: %x", output.PubKeyHash))
+	lines = append(lines, fmt.Sprintf("       ScriptPubKey: %s", output.ScriptPubKey))
 
 	return strings.Join(lines, "\n")
 }
 
 // TXOutputs collects TXOutput
+// key是输出在交易Vout里面的索引, 部分输出被花费之后, 剩下的输出的索引不能改变
 type TXOutputs struct {
-	Outputs []TXOutput
+	Outputs map[int]TXOutput
 }
 
 // Serialize serializes TXOutputs
@@ -94,16 +106,10 @@ type TXInput struct {
 	Txid []byte
 	//引用了Txid这个交易的输出的索引
 	Vout int
-	//ScriptSig string
-	Signature []byte
-	// input保存的公钥, 这是因为签名验证的时候, 需要拿出该公钥进行验证; output保存的是公钥的哈希, 这是因为输出不需要公钥做验证
-	PubKey []byte
-}
-
-func (in *TXInput) UsesKey(pubKeyHash []byte) bool {
-	lockingHash := HashPubKey(in.PubKey)
-
-	return bytes.Compare(lockingHash, pubKeyHash) == 0
+	// ScriptSig 解锁脚本, 只能包含压栈操作, P2PKH的是 <sig> <pubKey>; coinbase里面保存的是任意数据
+	ScriptSig Script
+	// Sequence 序列号, 用于相对时间锁, 参考CalcSequenceLock
+	Sequence uint32
 }
 
 // IsCoinbase checks whether the transaction is coinbase
@@ -138,17 +144,50 @@ func DeserializeTransaction(data []byte) Transaction {
 }
 
 // Hash returns the hash of the Transaction
+// 交易id在签名之前就计算好了, 所以普通交易的解锁脚本不参与hash, 签名之后id不变;
+// coinbase的解锁脚本是矿工填的任意数据, 必须参与hash, 否则付给同一个地址的coinbase的id会相同
 func (tx *Transaction) Hash() []byte {
-	var hash [32]byte
+	hash := sha256.Sum256(tx.hashData(tx.IsCoinbase()))
 
-	txCopy := *tx
-	txCopy.ID = []byte{}
+	return hash[:]
+}
 
-	log.Printf("txCopy:%s\n", txCopy)
-	log.Printf("txCopy.Serialize()=>%x", txCopy.Serialize())
-	hash = sha256.Sum256(txCopy.Serialize())
+// hashData 计算交易id和Merkle根用到的编码, withScriptSigs 表示是否包括解锁脚本.
+// 不能使用Serialize: gob给每个类型分配的编号是整个进程共用的, 按类型第一次被使用的顺序分配,
+// 并且会写进每一个新的Encoder的输出里面, 同一个交易在不同的节点上会得到不同的字节.
+// 这里按固定的顺序写出每个字段, 变长的字段前面加上长度, 结果只取决于交易本身
+func (tx *Transaction) hashData(withScriptSigs bool) []byte {
+	var buff bytes.Buffer
 
-	return hash[:]
+	writeUint64 := func(v uint64) {
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], v)
+		buff.Write(b[:])
+	}
+	writeBytes := func(data []byte) {
+		writeUint64(uint64(len(data)))
+		buff.Write(data)
+	}
+
+	writeUint64(uint64(len(tx.Vin)))
+	for _, vin := range tx.Vin {
+		writeBytes(vin.Txid)
+		writeUint64(uint64(vin.Vout))
+		if withScriptSigs {
+			writeBytes(vin.ScriptSig)
+		}
+		writeUint64(uint64(vin.Sequence))
+	}
+
+	writeUint64(uint64(len(tx.Vout)))
+	for _, vout := range tx.Vout {
+		writeUint64(uint64(vout.Value))
+		writeBytes(vout.ScriptPubKey)
+	}
+
+	writeUint64(uint64(tx.LockTime))
+
+	return buff.Bytes()
 }
 
 // func (in *TXInput) CanUnlockOutputWith(unlockingData string) bool {
@@ -159,46 +198,190 @@ func (tx *Transaction) Hash() []byte {
 // 	return out.ScriptPubKey == unlockingData
 // }
 
-func NewUTXOTransaction(wallet *Wallet, from, to string, amount int, UTXOSet *UTXOSet) *Transaction {
+// Recipient 交易的一个收款人
+type Recipient struct {
+	Address string
+	Amount  int
+}
+
+// SendOptions 创建交易时的可选参数
+type SendOptions struct {
+	// LockTime 不为0时交易在该高度或者时间之后才能被打包
+	LockTime uint32
+	// Fee 付给矿工的手续费, 从找零里面扣除
+	Fee int
+	// CoinSelector 选择输入的策略, nil时使用LargestFirstSelector
+	CoinSelector CoinSelector
+	// Outpoints 不为空时只使用这些输出作为输入, 不再自动选择
+	Outpoints []Outpoint
+	// ChangeAddress 找零地址, 为空时找零给from
+	ChangeAddress string
+	// FundingAddresses 除了from之外, 还可以花费这些地址的输出, 一般是from以前的找零地址
+	FundingAddresses []string
+	// Data 不为nil时添加一个携带这些数据的OP_RETURN输出
+	Data []byte
+	// Replaceable 交易在确认之前可以被手续费更高的交易替换(replace-by-fee)
+	Replaceable bool
+}
+
+// NewUTXOTransaction 创建一个从from转账到to的交易, lockTime不为0时交易在该高度或者时间之后才能被打包
+func NewUTXOTransaction(wallet *Wallet, from, to string, amount int, lockTime uint32, UTXOSet *UTXOSet) *Transaction {
+	tx := NewUnsignedUTXOTransaction(from, to, amount, lockTime, UTXOSet)
+	UTXOSet.Blockchain.SignTransaction(tx, wallet.PrivateKey)
+	log.Printf("\nnewTx:%s\n\n", tx)
+	return tx
+}
+
+// NewSendManyTransaction 创建一个从from同时转账给多个收款人的交易, 只有一个找零输出
+// 输入可能来自from的找零地址, 所以用wallets里面所有的私钥签名
+func NewSendManyTransaction(wallets *Wallets, from string, recipients []Recipient, opts SendOptions, UTXOSet *UTXOSet) *Transaction {
+	tx := NewUnsignedSendManyTransaction(from, recipients, opts, UTXOSet)
+	tx = wallets.SignTransaction(tx, UTXOSet.Blockchain)
+	log.Printf("\nnewTx:%s\n\n", tx)
+	return tx
+}
+
+// NewUnsignedUTXOTransaction 创建一个从from转账到to的交易, 但是不签名
+// from可以是P2SH地址, 这时候交易需要多个钱包签名, 参考PartiallySignedTx
+func NewUnsignedUTXOTransaction(from, to string, amount int, lockTime uint32, UTXOSet *UTXOSet) *Transaction {
+	return NewUnsignedSendManyTransaction(from, []Recipient{{to, amount}}, SendOptions{LockTime: lockTime}, UTXOSet)
+}
+
+// NewUnsignedSendManyTransaction 创建一个从from同时转账给多个收款人的交易, 但是不签名
+func NewUnsignedSendManyTransaction(from string, recipients []Recipient, opts SendOptions, UTXOSet *UTXOSet) *Transaction {
 	var inputs []TXInput
 	var outputs []TXOutput
 
-	pubKeyHash := HashPubKey(wallet.PublicKey)
-	acc, validOutputs := UTXOSet.FindSpendableOutputs(pubKeyHash, amount)
+	if opts.Fee < 0 {
+		log.Panicf("ERROR: Invalid fee %d", opts.Fee)
+	}
 
-	log.Printf("\nvalidOutputs:%#v\n\n", validOutputs)
-	if acc < amount {
-		log.Panic("ERROR: Not enough funds")
+	amount := 0
+	for _, recipient := range recipients {
+		if recipient.Amount <= 0 {
+			log.Panicf("ERROR: Invalid amount %d for %s", recipient.Amount, recipient.Address)
+		}
+		amount += recipient.Amount
 	}
 
-	// Build a list of inputs
-	for txid, outs := range validOutputs {
-		txID, _ := hex.DecodeString(txid)
-
-		for _, out := range outs {
-			// 这里的out其实就是某个txID这个交易里面的Vout数组的索引
-			// input保存的公钥, 这是因为签名验证的时候, 需要拿出该公钥进行验证; output保存的是公钥的哈希, 这是因为输出不需要公钥做验证
-			input := TXInput{txID, out, nil, wallet.PublicKey}
-			inputs = append(inputs, input)
+	var fundingScripts []Script
+	for _, address := range append([]string{from}, opts.FundingAddresses...) {
+		script, err := PayToAddrScript(address)
+		if err != nil {
+			log.Panic(err)
 		}
+		fundingScripts = append(fundingScripts, script)
+	}
+	coins, err := selectCoins(fundingScripts, amount+opts.Fee, opts, UTXOSet)
+	if err != nil {
+		log.Panic("ERROR: ", err)
+	}
+	acc := sumCoins(coins)
+
+	// 序列号是最大值时LockTime不生效, 所以设置了LockTime的交易要用小一点的序列号
+	sequence := uint32(MaxSequence)
+	if opts.LockTime != 0 {
+		sequence = MaxSequence - 1
+	}
+	if opts.Replaceable {
+		sequence = MaxRBFSequence
+	}
+
+	// Build a list of inputs
+	for _, coin := range coins {
+		// 解锁脚本在签名的时候再填上
+		inputs = append(inputs, TXInput{coin.Txid, coin.Vout, nil, sequence})
 	}
 
 	// Build a list of outputs
-	// 这里虽然有2个output, 但是每一个地址最多只有一个output
-	outputs = append(outputs, *NewTXOutput(amount, to))
-	if acc > amount {
+	// 每个收款人一个output, 最后是找零
+	for _, recipient := range recipients {
+		outputs = append(outputs, *NewTXOutput(recipient.Amount, recipient.Address))
+	}
+	if opts.Data != nil {
+		dataScript, err := NullDataScript(opts.Data)
+		if err != nil {
+			log.Panic(err)
+		}
+		outputs = append(outputs, TXOutput{0, dataScript})
+	}
+	change := acc - amount - opts.Fee
+	// 分支定界选出的输入多出来的金额不超过找零的成本时不找零, 多出来的部分作为手续费
+	if bnb, ok := opts.CoinSelector.(BranchAndBoundSelector); ok && change <= bnb.CostOfChange {
+		change = 0
+	}
+	if change > 0 {
 		// 这里就是找零.
-		outputs = append(outputs, *NewTXOutput(acc-amount, from)) // a change
+		changeAddress := from
+		if opts.ChangeAddress != "" {
+			changeAddress = opts.ChangeAddress
+		}
+		outputs = append(outputs, *NewTXOutput(change, changeAddress)) // a change
 	}
 
-	tx := Transaction{nil, inputs, outputs}
+	tx := Transaction{nil, inputs, outputs, opts.LockTime}
 	tx.ID = tx.Hash()
-	UTXOSet.Blockchain.SignTransaction(&tx, wallet.PrivateKey)
-	log.Printf("\nnewTx:%s\n\n", tx)
 	return &tx
 }
 
+// selectCoins 选出锁定脚本属于lockingScripts, 金额不少于target的输出
+// opts.Outpoints不为空时只使用指定的输出
+func selectCoins(lockingScripts []Script, target int, opts SendOptions, UTXOSet *UTXOSet) ([]Coin, error) {
+	// 交易至少要有一个输入, 只携带数据的交易也是一样
+	if target <= 0 {
+		target = 1
+	}
+
+	if len(opts.Outpoints) == 0 {
+		selector := opts.CoinSelector
+		if selector == nil {
+			selector = LargestFirstSelector{}
+		}
+
+		var coins []Coin
+		for _, lockingScript := range lockingScripts {
+			coins = append(coins, UTXOSet.FindCoins(lockingScript)...)
+		}
+		log.Printf("\nspendable coins:%d, target:%d\n\n", len(coins), target)
+		return selector.SelectCoins(coins, target)
+	}
+
+	var coins []Coin
+	seen := make(map[string]bool)
+	for _, outpoint := range opts.Outpoints {
+		key := fmt.Sprintf("%x:%d", outpoint.Txid, outpoint.Vout)
+		if seen[key] {
+			return nil, fmt.Errorf("Output %s is selected twice", key)
+		}
+		seen[key] = true
+
+		coin, ok := UTXOSet.FindCoin(outpoint)
+		if !ok {
+			return nil, fmt.Errorf("Output %s is not found or already spent", key)
+		}
+		owned := false
+		for _, lockingScript := range lockingScripts {
+			owned = owned || coin.Output.IsLockedWithScript(lockingScript)
+		}
+		if !owned {
+			return nil, fmt.Errorf("Output %s does not belong to the sender", key)
+		}
+		coins = append(coins, coin)
+	}
+
+	if sumCoins(coins) < target {
+		return nil, ErrInsufficientFunds
+	}
+
+	return coins, nil
+}
+
 func NewCoinbaseTX(to, data string) *Transaction {
+	return NewCoinbaseTXWithFees(to, data, 0)
+}
+
+// NewCoinbaseTXWithFees 创建coinbase交易, 矿工得到区块奖励加上fees
+func NewCoinbaseTXWithFees(to, data string, fees int) *Transaction {
 	if data == "" {
 		randData := make([]byte, 20)
 		_, err := rand.Read(randData)
@@ -209,9 +392,9 @@ func NewCoinbaseTX(to, data string) *Transaction {
 		data = fmt.Sprintf("%x", randData)
 	}
 
-	txin := TXInput{[]byte{}, -1, nil, []byte(data)}
-	txout := *NewTXOutput(subsidy, to)
-	tx := Transaction{nil, []TXInput{txin}, []TXOutput{txout}}
+	txin := TXInput{[]byte{}, -1, NewScriptBuilder().AddData([]byte(data)).Script(), MaxSequence}
+	txout := *NewTXOutput(subsidy+fees, to)
+	tx := Transaction{nil, []TXInput{txin}, []TXOutput{txout}, 0}
 	tx.ID = tx.Hash()
 	log.Printf("\nnewCoinbaseTx:%s\n\n", tx)
 	return &tx
@@ -222,115 +405,118 @@ func (tx Transaction) String() string {
 	var lines []string
 
 	lines = append(lines, fmt.Sprintf("\n--- Transaction %x:", tx.ID))
+	lines = append(lines, fmt.Sprintf("     LockTime: %d", tx.LockTime))
 
 	for i, input := range tx.Vin {
 
 		lines = append(lines, fmt.Sprintf("     Input %d:", i))
 		lines = append(lines, fmt.Sprintf("       TXID:      %x", input.Txid))
 		lines = append(lines, fmt.Sprintf("       Out:       %d", input.Vout))
-		lines = append(lines, fmt.Sprintf("       Signature: %x", input.Signature))
-		lines = append(lines, fmt.Sprintf("       PubKey:    %x", input.PubKey))
+		lines = append(lines, fmt.Sprintf("       ScriptSig: %s", input.ScriptSig))
+		lines = append(lines, fmt.Sprintf("       Sequence:  %d", input.Sequence))
 	}
 
 	for i, output := range tx.Vout {
 		lines = append(lines, fmt.Sprintf("     Output %d:", i))
 		lines = append(lines, fmt.Sprintf("       Value:  %d", output.Value))
-		lines = append(lines, fmt.Sprintf("       PubKeyHash: %x", output.PubKeyHash))
+		lines = append(lines, fmt.Sprintf("       ScriptPubKey: %s", output.ScriptPubKey))
 	}
 
 	return strings.Join(lines, "\n")
 }
 
-// Sign 对交易签名, 签名之后的数据会放在input的Signature字段里面
+// Sign 对交易签名, 签名之后的解锁脚本会放在input的ScriptSig字段里面
+// 只能签名付给privKey对应公钥的P2PKH输入
 func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
 	if tx.IsCoinbase() {
 		return
 	}
 
-	txCopy := tx.TrimmedCopy()
+	pubKey := marshalPubKey(privKey.PublicKey)
 
-	for inID, vin := range txCopy.Vin {
+	for inID, vin := range tx.Vin {
 		// 从上一个块的交易列表中选出当前输入引用的那些tx
 		prevTx := prevTXs[hex.EncodeToString(vin.Txid)]
-		txCopy.Vin[inID].Signature = nil
-		// 把输入引用的"上一个交易输出的公钥哈希", 赋值过来
-		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.Vout].PubKeyHash
-		// 上面那些步骤就是为了计算出hash, 用来签名
-
-		//参考验证部分的注释
-		//txCopy.ID = txCopy.Hash()
+		prevOut := prevTx.Vout[vin.Vout]
+		if !prevOut.IsLockedWithKey(HashPubKey(pubKey)) {
+			log.Panicf("ERROR: Input %d is not locked with the signing key", inID)
+		}
 
-		txCopy.Vin[inID].PubKey = nil
-		dataToSign := fmt.Sprintf("%x", txCopy)
-		log.Printf("Sign Data:0x%s\n\n", dataToSign)
+		sig := tx.SignInput(privKey, inID, prevOut.ScriptPubKey)
+		tx.Vin[inID].ScriptSig = SignatureScript(sig, pubKey)
+	}
+}
 
-		r, s, err := ecdsa.Sign(rand.Reader, &privKey, []byte(dataToSign))
-		if err != nil {
-			panic(err)
-		}
-		signature := append(r.Bytes(), s.Bytes()...)
+// SignInput 用privKey对第inID个输入签名, subScript是该输入引用的输出的锁定脚本
+func (tx *Transaction) SignInput(privKey ecdsa.PrivateKey, inID int, subScript Script) []byte {
+	hash := tx.SignatureHash(inID, subScript)
 
-		tx.Vin[inID].Signature = signature
+	r, s, err := ecdsa.Sign(rand.Reader, &privKey, hash)
+	if err != nil {
+		panic(err)
 	}
+
+	// r和s都补齐到32字节, 验证的时候才能从中间切开
+	signature := make([]byte, 64)
+	rBytes, sBytes := r.Bytes(), s.Bytes()
+	copy(signature[32-len(rBytes):32], rBytes)
+	copy(signature[64-len(sBytes):], sBytes)
+
+	return signature
+}
+
+// SignatureHash 计算第inID个输入需要签名的数据
+// 所有输入的解锁脚本都清空, 只有被签名的输入换成它引用的输出的锁定脚本
+func (tx *Transaction) SignatureHash(inID int, subScript Script) []byte {
+	txCopy := tx.TrimmedCopy()
+	txCopy.Vin[inID].ScriptSig = subScript
+
+	//这里原先是用Hash作为签名数据, 但是从钱包节点->中心节点传过来的tx虽然字段值都一样, 但是序列化的字节却有一些不同, 导致最终hash出来的结果不同
+	//所以现在修改成直接把结构体打印成十六进制dataToSign再用于签名
+	dataToSign := fmt.Sprintf("%x", txCopy)
+	hash := sha256.Sum256([]byte(dataToSign))
+
+	return hash[:]
 }
 
-// TrimmedCopy 从交易中拷贝出需要用到的信息创建一个新的实例
+// TrimmedCopy 从交易中拷贝出需要用到的信息创建一个新的实例, 解锁脚本都是空的
 func (tx *Transaction) TrimmedCopy() Transaction {
 	var inputs []TXInput
 	var outputs []TXOutput
 
 	for _, vin := range tx.Vin {
-		inputs = append(inputs, TXInput{vin.Txid, vin.Vout, nil, nil})
+		inputs = append(inputs, TXInput{vin.Txid, vin.Vout, nil, vin.Sequence})
 	}
 
 	for _, vout := range tx.Vout {
-		outputs = append(outputs, TXOutput{vout.Value, vout.PubKeyHash})
+		outputs = append(outputs, TXOutput{vout.Value, vout.ScriptPubKey})
 	}
 
-	txCopy := Transaction{tx.ID, inputs, outputs}
+	txCopy := Transaction{tx.ID, inputs, outputs, tx.LockTime}
 
 	return txCopy
 }
 
-// Verify 验证每一个tx里面的签名
+// Verify 对每一个输入执行解锁脚本和它引用的输出的锁定脚本
 func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 	// Coinbase 为矿工奖励, 所以不需要验证
 	if tx.IsCoinbase() {
 		return true
 	}
 
-	txCopy := tx.TrimmedCopy()
-	curve := elliptic.P256()
-
 	for inID, vin := range tx.Vin {
-		// 这里和签名的代码一样
 		prevTx := prevTXs[hex.EncodeToString(vin.Txid)]
-		txCopy.Vin[inID].Signature = nil
-		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.Vout].PubKeyHash
-
-		//这里原先是用Hash作为签名数据, 但是从钱包节点->中心节点传过来的tx虽然字段值都一样, 但是序列化的字节却有一些不同, 导致最终hash出来的结果不同
-		//所以现在修改成直接把结构体打印成十六进制dataToSign再用于签名
-		//txCopy.ID = txCopy.Hash()
-
-		txCopy.Vin[inID].PubKey = nil
-
-		r := big.Int{}
-		s := big.Int{}
-		sigLen := len(vin.Signature)
-		r.SetBytes(vin.Signature[:(sigLen / 2)])
-		s.SetBytes(vin.Signature[(sigLen / 2):])
-
-		x := big.Int{}
-		y := big.Int{}
-		keyLen := len(vin.PubKey)
-		x.SetBytes(vin.PubKey[:(keyLen / 2)])
-		y.SetBytes(vin.PubKey[(keyLen / 2):])
-
-		rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
+		if vin.Vout < 0 || vin.Vout >= len(prevTx.Vout) {
+			log.Printf("Verify: input %d of tx 0x%x spends unknown output\n", inID, tx.ID)
+			return false
+		}
 
-		dataToSign := fmt.Sprintf("%x", txCopy)
-		log.Printf("Verify Data:0x%x\n", dataToSign)
-		if ecdsa.Verify(&rawPubKey, []byte(dataToSign), &r, &s) == false {
+		vm, err := NewEngine(prevTx.Vout[vin.Vout].ScriptPubKey, tx, inID)
+		if err == nil {
+			err = vm.Execute()
+		}
+		if err != nil {
+			log.Printf("Verify: input %d of tx 0x%x: %s\n", inID, tx.ID, err)
 			return false
 		}
 	}
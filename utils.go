@@ -1,5 +1,18 @@
 package main
 
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// dataDir 保存区块链、钱包、交易池和配置文件的目录, 可以用环境变量DATA_DIR或者startnode -datadir修改
+var dataDir = "db"
+
+// dataFile 返回数据目录里面的文件路径, format是带一个%s的文件名, 例如 blockchain_%s.db
+func dataFile(format, nodeID string) string {
+	return filepath.Join(dataDir, fmt.Sprintf(format, nodeID))
+}
+
 func IntToHex(n int64) []byte {
 	// int64 占用64个bit, 8个字节
 	var dst [8]byte
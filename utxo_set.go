@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/hex"
+	"fmt"
 	"log"
 
 	"github.com/boltdb/bolt"
@@ -9,6 +10,13 @@ import (
 
 const utxoBucket = "chainstate"
 
+// chainstateMetaBucket 保存UTXO集的格式版本
+const chainstateMetaBucket = "chainstate_meta"
+
+// chainstateVersion UTXO集的格式版本, 数据库里面的版本不同时重新构建UTXO集.
+// 2: TXOutputs.Outputs 从切片改成了按输出索引保存的map
+const chainstateVersion = 2
+
 type UTXOSet struct {
 	Blockchain *Blockchain
 }
@@ -48,14 +56,42 @@ func (u UTXOSet) Reindex() {
 				log.Panic(err)
 			}
 		}
+
+		meta, err := tx.CreateBucketIfNotExists([]byte(chainstateMetaBucket))
+		if err != nil {
+			return err
+		}
+		return meta.Put([]byte("version"), []byte{chainstateVersion})
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// ReindexIfOutdated UTXO集是旧版本的格式时重新构建, 旧格式的数据无法用DeserializeOutputs解析
+func (u UTXOSet) ReindexIfOutdated() {
+	current := false
+
+	err := u.Blockchain.db.View(func(tx *bolt.Tx) error {
+		if meta := tx.Bucket([]byte(chainstateMetaBucket)); meta != nil {
+			version := meta.Get([]byte("version"))
+			current = len(version) == 1 && version[0] == chainstateVersion
+		}
 		return nil
 	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if !current {
+		fmt.Println("The chainstate is in an old format, reindexing...")
+		u.Reindex()
+	}
 }
 
-// FindSpendableOutputs 找到可供消费的输出
-func (u UTXOSet) FindSpendableOutputs(pubkeyHash []byte, amount int) (int, map[string][]int) {
-	unspentOutputs := make(map[string][]int)
-	accumulated := 0
+// FindCoins 找到锁定脚本为lockingScript的所有未花费的输出, 以及它们的位置
+func (u UTXOSet) FindCoins(lockingScript Script) []Coin {
+	var coins []Coin
 	db := u.Blockchain.db
 
 	err := db.View(func(tx *bolt.Tx) error {
@@ -63,13 +99,12 @@ func (u UTXOSet) FindSpendableOutputs(pubkeyHash []byte, amount int) (int, map[s
 		c := b.Cursor()
 
 		for k, v := c.First(); k != nil; k, v = c.Next() {
-			txID := hex.EncodeToString(k)
 			outs := DeserializeOutputs(v)
 
 			for outIdx, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubkeyHash) && accumulated < amount {
-					accumulated += out.Value
-					unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
+				if out.IsLockedWithScript(lockingScript) {
+					txID := append([]byte{}, k...)
+					coins = append(coins, Coin{Outpoint{txID, outIdx}, out})
 				}
 			}
 		}
@@ -79,11 +114,38 @@ func (u UTXOSet) FindSpendableOutputs(pubkeyHash []byte, amount int) (int, map[s
 	if err != nil {
 		log.Panic(err)
 	}
-	return accumulated, unspentOutputs
+	return coins
 }
 
-// FindUTXO 查询未花费的输出
-func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
+// FindCoin 查询outpoint指向的输出, 已经被花费或者不存在时返回false
+func (u UTXOSet) FindCoin(outpoint Outpoint) (Coin, bool) {
+	var coin Coin
+	found := false
+	db := u.Blockchain.db
+
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		outsBytes := b.Get(outpoint.Txid)
+		if outsBytes == nil {
+			return nil
+		}
+
+		out, ok := DeserializeOutputs(outsBytes).Outputs[outpoint.Vout]
+		if ok {
+			coin = Coin{outpoint, out}
+			found = true
+		}
+		return nil
+	})
+
+	if err != nil {
+		log.Panic(err)
+	}
+	return coin, found
+}
+
+// FindUTXO 查询锁定脚本为lockingScript的未花费的输出
+func (u UTXOSet) FindUTXO(lockingScript Script) []TXOutput {
 	var UTXOs []TXOutput
 	db := u.Blockchain.db
 
@@ -95,7 +157,7 @@ func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
 			outs := DeserializeOutputs(v)
 
 			for _, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) {
+				if out.IsLockedWithScript(lockingScript) {
 					log.Printf("\nTid:%x, out:%s\n", k, out)
 					UTXOs = append(UTXOs, out)
 				}
@@ -122,14 +184,14 @@ func (u UTXOSet) Update(block *Block) {
 			// Coinbase的交易没有输入, 也就是没有引用任何输出, 所以不需要去更新输出集了
 			if tx.IsCoinbase() == false {
 				for _, vin := range tx.Vin {
-					updatedOuts := TXOutputs{}
+					updatedOuts := TXOutputs{make(map[int]TXOutput)}
 					outsBytes := b.Get(vin.Txid)
 					// 从交易的输入里面得到上一个区块对应的交易id哈希, 再用交易哈希用utxo集里面取出输出, 把这个输出从utxo集里面删除
 					outs := DeserializeOutputs(outsBytes)
 
 					for outIdx, out := range outs.Outputs {
 						if outIdx != vin.Vout {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
+							updatedOuts.Outputs[outIdx] = out
 						}
 					}
 
@@ -140,7 +202,7 @@ func (u UTXOSet) Update(block *Block) {
 							log.Panic(err)
 						}
 					} else {
-						log.Printf("Put vin.Txid:%x \nupdatedOuts%s", vin.Txid, updatedOuts)
+						log.Printf("Put vin.Txid:%x \nupdatedOuts%v", vin.Txid, updatedOuts)
 						err := b.Put(vin.Txid, updatedOuts.Serialize())
 						if err != nil {
 							log.Panic(err)
@@ -150,11 +212,17 @@ func (u UTXOSet) Update(block *Block) {
 			}
 
 			// 把新的输出加到集合里面
-			newOutputs := TXOutputs{}
-			for _, out := range tx.Vout {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
+			newOutputs := TXOutputs{make(map[int]TXOutput)}
+			for outIdx, out := range tx.Vout {
+				// OP_RETURN的输出永远不能花费, 不放进UTXO集合
+				if !out.ScriptPubKey.IsUnspendable() {
+					newOutputs.Outputs[outIdx] = out
+				}
+			}
+			if len(newOutputs.Outputs) == 0 {
+				continue
 			}
-			log.Printf("Put tx.ID:%x \nnewOutputs:%s", tx.ID, newOutputs)
+			log.Printf("Put tx.ID:%x \nnewOutputs:%v", tx.ID, newOutputs)
 			err := b.Put(tx.ID, newOutputs.Serialize())
 			if err != nil {
 				log.Panic(err)
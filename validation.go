@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// ValidateBlock 检查一个从网络收到的区块是否可以加入到链上
+// skipSigs 为true时不验证交易签名, 参考AssumeValid
+func (bc *Blockchain) ValidateBlock(block *Block, skipSigs bool) error {
+	if size := len(block.Serialize()); size > activeNetParams.MaxBlockSize {
+		return fmt.Errorf("Block 0x%x size %d exceeds limit %d", block.Hash, size, activeNetParams.MaxBlockSize)
+	}
+
+	err := checkProofOfWork(block)
+	if err != nil {
+		return err
+	}
+
+	// 每个节点都是从同一个创世块开始的, 收到别的创世块说明不是同一条链
+	if len(block.PrevBlockHash) == 0 {
+		return fmt.Errorf("Genesis block 0x%x does not match ours", block.Hash)
+	}
+
+	prevBlock, err := bc.GetBlock(block.PrevBlockHash)
+	if err != nil {
+		return fmt.Errorf("Previous block 0x%x of block 0x%x is not found", block.PrevBlockHash, block.Hash)
+	}
+
+	if block.Height != prevBlock.Height+1 {
+		return fmt.Errorf("Block 0x%x has wrong height %d", block.Hash, block.Height)
+	}
+
+	err = bc.checkBlockTime(block)
+	if err != nil {
+		return err
+	}
+
+	err = bc.checkCheckpoints(block)
+	if err != nil {
+		return err
+	}
+
+	return bc.checkBlockTransactions(block, skipSigs)
+}
+
+// checkProofOfWork 区块的hash必须是区块头的hash, 并且满足工作量证明
+func checkProofOfWork(block *Block) error {
+	pow := NewProofOfWork(block)
+	hash := sha256.Sum256(pow.prepareData(block.Nonce))
+	if bytes.Compare(hash[:], block.Hash) != 0 || !pow.Validate() {
+		return fmt.Errorf("Block 0x%x has invalid proof of work", block.Hash)
+	}
+
+	return nil
+}
+
+// checkBlockTime 区块时间必须比前面区块时间的中位数大, 并且不能比网络时间超前太多
+func (bc *Blockchain) checkBlockTime(block *Block) error {
+	medianTime := bc.CalcPastMedianTime(block.PrevBlockHash)
+	if block.Timestamp <= medianTime {
+		return fmt.Errorf("Block 0x%x timestamp %d is not after median time %d", block.Hash, block.Timestamp, medianTime)
+	}
+
+	maxTimestamp := timeSource.AdjustedTime() + activeNetParams.MaxFutureBlockTime
+	if block.Timestamp > maxTimestamp {
+		return fmt.Errorf("Block 0x%x timestamp %d is too far in the future", block.Hash, block.Timestamp)
+	}
+
+	return nil
+}
+
+// checkCheckpoints 区块不能和检查点冲突, 也不能从已经通过的检查点之前分叉出去
+func (bc *Blockchain) checkCheckpoints(block *Block) error {
+	checkpointHash, ok := activeNetParams.checkpointAt(block.Height)
+	if ok && bytes.Compare(checkpointHash, block.Hash) != 0 {
+		return fmt.Errorf("Block 0x%x conflicts with checkpoint at height %d", block.Hash, block.Height)
+	}
+
+	lastHeight := bc.lastCheckpointHeight()
+	if block.Height < lastHeight {
+		return fmt.Errorf("Block 0x%x forks the chain before checkpoint at height %d", block.Hash, lastHeight)
+	}
+
+	// 只比较高度的话, 检查点之前分叉出去的链在超过检查点的高度之后仍然可以接上来, 所以还要检查区块是检查点的后代
+	if block.Height > lastHeight && lastHeight >= 0 {
+		checkpointHash, _ := activeNetParams.checkpointAt(lastHeight)
+		ancestor, err := bc.ancestorHash(block.PrevBlockHash, lastHeight)
+		if err != nil || bytes.Compare(ancestor, checkpointHash) != 0 {
+			return fmt.Errorf("Block 0x%x does not descend from checkpoint at height %d", block.Hash, lastHeight)
+		}
+	}
+
+	return nil
+}
+
+// ancestorHash 从blockHash沿着PrevBlockHash往前, 返回高度为height的祖先的hash, 这些区块都必须在本地
+func (bc *Blockchain) ancestorHash(blockHash []byte, height int) ([]byte, error) {
+	for {
+		block, err := bc.GetBlock(blockHash)
+		if err != nil {
+			return nil, err
+		}
+		if block.Height <= height {
+			return block.Hash, nil
+		}
+		blockHash = block.PrevBlockHash
+	}
+}
+
+// lastCheckpointHeight 本地已经有的最高的那个检查点的高度, 一个都没有时返回-1
+func (bc *Blockchain) lastCheckpointHeight() int {
+	checkpoints := activeNetParams.Checkpoints
+
+	for i := len(checkpoints) - 1; i >= 0; i-- {
+		hash, _ := hex.DecodeString(checkpoints[i].Hash)
+		if _, err := bc.GetBlock(hash); err == nil {
+			return checkpoints[i].Height
+		}
+	}
+
+	return -1
+}
+
+// AssumeValid 判断同步区块时是否可以跳过签名验证: block必须就是assume valid区块, 或者是它的祖先.
+// 祖先关系只能由已经收到的区块证明, 也就是从assume valid区块沿着PrevBlockHash往前可以一直连到block,
+// 中间的区块在链上或者在孤儿区块池里面. 对方inv里面的列表可以随意填写, 不能作为依据
+func (bc *Blockchain) AssumeValid(block *Block) bool {
+	if activeNetParams.AssumeValid == "" || block.Height > activeNetParams.AssumeValidHeight {
+		return false
+	}
+
+	hash, err := hex.DecodeString(activeNetParams.AssumeValid)
+	if err != nil {
+		panic(err)
+	}
+
+	for {
+		if bytes.Compare(hash, block.Hash) == 0 {
+			return true
+		}
+
+		var header *Block
+		if chainBlock, err := bc.GetBlock(hash); err == nil {
+			header = &chainBlock
+		} else if orphan, ok := orphanBlocks.Get(hash); ok && checkProofOfWork(orphan) == nil {
+			// 孤儿区块还没有验证过, 至少要确认它的hash和内容一致, 否则谁都可以发一个hash字段是assume valid的区块
+			header = orphan
+		} else {
+			return false
+		}
+
+		if header.Height <= block.Height {
+			return false
+		}
+		hash = header.PrevBlockHash
+	}
+}
+
+// checkBlockTransactions 检查区块里面每一个交易引用的输出是否存在, 金额和签名是否正确
+// coinbase的金额不能超过区块奖励加上所有交易的手续费
+func (bc *Blockchain) checkBlockTransactions(block *Block, skipSigs bool) error {
+	if len(block.Transactions) == 0 {
+		return errors.New("Block has no transactions")
+	}
+
+	// 交易可以花费同一个区块里面排在它前面的交易的输出
+	prevTXs := make(map[string]Transaction)
+	pending := make(map[string]bool)
+	// 其他输入必须是父块那条链上还没有被花费的输出, 并且在区块里面只能被花费一次
+	isUnspent := bc.unspentChecker(block.PrevBlockHash)
+	spent := make(map[string]bool)
+	medianTime := bc.CalcPastMedianTime(block.PrevBlockHash)
+	totalFees := 0
+	coinbaseValue := 0
+
+	for i, tx := range block.Transactions {
+		err := CheckTransactionSize(tx)
+		if err != nil {
+			return err
+		}
+
+		err = CheckTransactionID(tx)
+		if err != nil {
+			return err
+		}
+
+		// 区块的第一个交易必须是coinbase, 并且只能有一个
+		if tx.IsCoinbase() != (i == 0) {
+			return fmt.Errorf("Transaction %d 0x%x: coinbase must be the first and only the first transaction", i, tx.ID)
+		}
+
+		// coinbase的输出不能在同一个区块里面花费, 所以不放进prevTXs和pending
+		if tx.IsCoinbase() {
+			for _, out := range tx.Vout {
+				if out.Value < 0 {
+					return fmt.Errorf("Coinbase 0x%x has negative output value", tx.ID)
+				}
+				coinbaseValue += out.Value
+			}
+			continue
+		}
+
+		for _, vin := range tx.Vin {
+			prevTX, ok := prevTXs[hex.EncodeToString(vin.Txid)]
+			if !ok {
+				prevTX, err = bc.FindTransaction(vin.Txid)
+				if err != nil {
+					return fmt.Errorf("Transaction 0x%x spends unknown transaction 0x%x", tx.ID, vin.Txid)
+				}
+				prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+			}
+
+			if vin.Vout < 0 || vin.Vout >= len(prevTX.Vout) {
+				return fmt.Errorf("Transaction 0x%x spends unknown output %x:%d", tx.ID, vin.Txid, vin.Vout)
+			}
+
+			key := outpointKey(vin.Txid, vin.Vout)
+			if spent[key] {
+				return fmt.Errorf("Transaction 0x%x spends output %s that is already spent in the block", tx.ID, key)
+			}
+			spent[key] = true
+
+			if !pending[hex.EncodeToString(vin.Txid)] && !isUnspent(Outpoint{vin.Txid, vin.Vout}) {
+				return fmt.Errorf("Transaction 0x%x spends missing or spent output %s", tx.ID, key)
+			}
+		}
+
+		fee, err := CheckTransactionInputs(tx, prevTXs)
+		if err != nil {
+			return err
+		}
+		totalFees += fee
+
+		err = bc.CheckTransactionLocks(tx, block.Height, medianTime, pending)
+		if err != nil {
+			return err
+		}
+
+		if !skipSigs && !tx.Verify(prevTXs) {
+			return fmt.Errorf("Transaction 0x%x has invalid signature", tx.ID)
+		}
+
+		prevTXs[hex.EncodeToString(tx.ID)] = *tx
+		pending[hex.EncodeToString(tx.ID)] = true
+	}
+
+	if coinbaseValue > subsidy+totalFees {
+		return fmt.Errorf("Coinbase pays %d, more than subsidy %d plus fees %d", coinbaseValue, subsidy, totalFees)
+	}
+
+	return nil
+}
+
+// unspentChecker 返回判断输出在以blockHash结尾的链上是否还没有被花费的函数.
+// blockHash是链的最高区块时直接查询UTXO集, 否则是分叉上的区块, 从blockHash往前重新计算
+func (bc *Blockchain) unspentChecker(blockHash []byte) func(Outpoint) bool {
+	if bytes.Compare(blockHash, bc.tip) == 0 {
+		UTXOSet := UTXOSet{bc}
+		return func(outpoint Outpoint) bool {
+			_, ok := UTXOSet.FindCoin(outpoint)
+			return ok
+		}
+	}
+
+	UTXO := bc.FindUTXOAt(blockHash)
+	return func(outpoint Outpoint) bool {
+		_, ok := UTXO[hex.EncodeToString(outpoint.Txid)].Outputs[outpoint.Vout]
+		return ok
+	}
+}
+
+// CheckTransactionInputs 检查交易的输出金额都不是负数, 并且总额不超过输入, 返回手续费
+// prevTXs里面必须有交易所有输入引用的交易
+func CheckTransactionInputs(tx *Transaction, prevTXs map[string]Transaction) (int, error) {
+	// 同一个输出被引用两次时金额会被算两次, 每个输入的签名又是单独验证的, 所以必须拒绝
+	err := CheckDuplicateInputs(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	valueIn := 0
+	for _, vin := range tx.Vin {
+		prevTX, ok := prevTXs[hex.EncodeToString(vin.Txid)]
+		if !ok || vin.Vout < 0 || vin.Vout >= len(prevTX.Vout) {
+			return 0, fmt.Errorf("Transaction 0x%x spends unknown output %x:%d", tx.ID, vin.Txid, vin.Vout)
+		}
+		valueIn += prevTX.Vout[vin.Vout].Value
+	}
+
+	valueOut := 0
+	for _, out := range tx.Vout {
+		if out.Value < 0 {
+			return 0, fmt.Errorf("Transaction 0x%x has negative output value", tx.ID)
+		}
+		valueOut += out.Value
+	}
+
+	if valueIn < valueOut {
+		return 0, fmt.Errorf("Transaction 0x%x spends %d, more than its inputs %d", tx.ID, valueOut, valueIn)
+	}
+
+	return valueIn - valueOut, nil
+}
+
+// CheckDuplicateInputs 交易的输入不能引用同一个输出
+func CheckDuplicateInputs(tx *Transaction) error {
+	seen := make(map[string]bool)
+	for _, vin := range tx.Vin {
+		key := outpointKey(vin.Txid, vin.Vout)
+		if seen[key] {
+			return fmt.Errorf("bad-txns-inputs-duplicate: transaction 0x%x spends output %s twice", tx.ID, key)
+		}
+		seen[key] = true
+	}
+
+	return nil
+}
+
+// CheckTransactionID 交易id必须是交易内容的hash, 否则发送方可以随意指定交易在交易池和孤儿交易池里面的id
+func CheckTransactionID(tx *Transaction) error {
+	if hash := tx.Hash(); bytes.Compare(tx.ID, hash) != 0 {
+		return fmt.Errorf("bad-txns-id: transaction 0x%x has hash 0x%x", tx.ID, hash)
+	}
+
+	return nil
+}
+
+// CheckTransactionSize 检查交易序列化之后的大小是否超过限制
+func CheckTransactionSize(tx *Transaction) error {
+	if size := len(tx.Serialize()); size > activeNetParams.MaxTxSize {
+		return fmt.Errorf("Transaction 0x%x size %d exceeds limit %d", tx.ID, size, activeNetParams.MaxTxSize)
+	}
+
+	return nil
+}
@@ -6,13 +6,18 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/gob"
 	"log"
+	"math/big"
 
 	"golang.org/x/crypto/ripemd160"
 )
 
 const version = byte(0x00)
-const walletFile = "db/wallet_%s.dat"
+
+// scriptHashVersion P2SH地址的版本号, 编码之后以3开头
+const scriptHashVersion = byte(0x05)
+const walletFile = "wallet_%s.dat"
 const addressChecksumLen = 4
 
 type Wallet struct {
@@ -27,6 +32,81 @@ func NewWallet() *Wallet {
 	return &wallet
 }
 
+// walletData 钱包文件里面保存的格式, 曲线固定是P256, 只需要保存私钥的D
+// ecdsa.PrivateKey里面的曲线没有导出的字段, gob无法直接序列化
+type walletData struct {
+	D         []byte
+	PublicKey []byte
+}
+
+// GobEncode 实现gob.GobEncoder
+func (w Wallet) GobEncode() ([]byte, error) {
+	var buff bytes.Buffer
+
+	err := gob.NewEncoder(&buff).Encode(walletData{w.PrivateKey.D.Bytes(), w.PublicKey})
+	if err != nil {
+		return nil, err
+	}
+
+	return buff.Bytes(), nil
+}
+
+// GobDecode 实现gob.GobDecoder
+func (w *Wallet) GobDecode(data []byte) error {
+	var wd walletData
+
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&wd)
+	if err != nil {
+		return err
+	}
+
+	curve := elliptic.P256()
+	w.PrivateKey.Curve = curve
+	w.PrivateKey.D = new(big.Int).SetBytes(wd.D)
+	w.PrivateKey.PublicKey.X, w.PrivateKey.PublicKey.Y = curve.ScalarBaseMult(wd.D)
+	// 旧版本保存的公钥坐标没有补齐, 从私钥重新计算
+	w.PublicKey = marshalPubKey(w.PrivateKey.PublicKey)
+
+	return nil
+}
+
+// legacyWallets 旧的钱包文件格式, 直接用gob保存了ecdsa.PrivateKey, 并且只有钱包没有其他数据.
+// 里面的曲线是注册过的接口类型, 新版本的Go已经没有这个类型了, 解码时不声明这个字段就会被跳过
+type legacyWallets struct {
+	Wallets map[string]*struct {
+		PrivateKey struct {
+			PublicKey struct {
+				X, Y *big.Int
+			}
+			D *big.Int
+		}
+		PublicKey []byte
+	}
+}
+
+// decodeLegacyWallets 读取旧格式的钱包文件, 曲线固定是P256
+func decodeLegacyWallets(data []byte) (Wallets, error) {
+	var legacy legacyWallets
+
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&legacy)
+	if err != nil {
+		return Wallets{}, err
+	}
+
+	wallets := Wallets{Wallets: make(map[string]*Wallet)}
+	for address, lw := range legacy.Wallets {
+		var privateKey ecdsa.PrivateKey
+		privateKey.Curve = elliptic.P256()
+		privateKey.D = lw.PrivateKey.D
+		privateKey.PublicKey.X = lw.PrivateKey.PublicKey.X
+		privateKey.PublicKey.Y = lw.PrivateKey.PublicKey.Y
+
+		wallets.Wallets[address] = &Wallet{privateKey, marshalPubKey(privateKey.PublicKey)}
+	}
+
+	return wallets, nil
+}
+
 func newKeyPair() (ecdsa.PrivateKey, []byte) {
 	curve := elliptic.P256()
 	private, err := ecdsa.GenerateKey(curve, rand.Reader)
@@ -34,9 +114,18 @@ func newKeyPair() (ecdsa.PrivateKey, []byte) {
 		log.Panic(err)
 	}
 
-	pubKey := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+	return *private, marshalPubKey(private.PublicKey)
+}
+
+// marshalPubKey 公钥的编码: X和Y坐标各自补齐到32字节之后拼接起来, 验证签名的时候从中间切开.
+// 坐标开头的字节是0时big.Int.Bytes()会少一个字节, 不补齐的话切开的位置就错了
+func marshalPubKey(pub ecdsa.PublicKey) []byte {
+	pubKey := make([]byte, 64)
+	xBytes, yBytes := pub.X.Bytes(), pub.Y.Bytes()
+	copy(pubKey[32-len(xBytes):32], xBytes)
+	copy(pubKey[64-len(yBytes):], yBytes)
 
-	return *private, pubKey
+	return pubKey
 }
 
 func HashPubKey(pubKey []byte) []byte {
@@ -67,9 +156,28 @@ func checksum(payload []byte) []byte {
 }
 
 func (w Wallet) GetAddress() []byte {
-	pubKeyHash := HashPubKey(w.PublicKey)
+	return PubKeyHashToAddress(HashPubKey(w.PublicKey))
+}
+
+// PubKeyHashToAddress 把公钥哈希编码成地址
+func PubKeyHashToAddress(pubKeyHash []byte) []byte {
+	return encodeAddress(version, pubKeyHash)
+}
+
+// ScriptHashToAddress 把赎回脚本的哈希编码成P2SH地址
+func ScriptHashToAddress(scriptHash []byte) []byte {
+	return encodeAddress(scriptHashVersion, scriptHash)
+}
 
-	versionedPayload := append([]byte{version}, pubKeyHash...)
+// DecodeAddress 返回地址的版本号和里面的哈希, 调用之前要先用ValidateAddress检查
+func DecodeAddress(address string) (byte, []byte) {
+	payload := Base58Decode([]byte(address))
+
+	return payload[0], payload[1 : len(payload)-addressChecksumLen]
+}
+
+func encodeAddress(version byte, hash []byte) []byte {
+	versionedPayload := append([]byte{version}, hash...)
 	checksum := checksum(versionedPayload)
 
 	fullPayload := append(versionedPayload, checksum...)
@@ -80,10 +188,11 @@ func (w Wallet) GetAddress() []byte {
 
 // ValidateAddress check if address if valid
 func ValidateAddress(address string) bool {
-	if len(address) != 34 {
+	// 版本号1个字节, 哈希20个字节, 校验和4个字节
+	pubKeyHash := Base58Decode([]byte(address))
+	if len(pubKeyHash) != 1+pubKeyHashLen+addressChecksumLen {
 		return false
 	}
-	pubKeyHash := Base58Decode([]byte(address))
 	actualChecksum := pubKeyHash[len(pubKeyHash)-addressChecksumLen:]
 	version := pubKeyHash[0]
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-addressChecksumLen]
@@ -2,23 +2,40 @@ package main
 
 import (
 	"bytes"
-	"crypto/elliptic"
 	"encoding/gob"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"sort"
 )
 
 // Wallets stores a collection of wallets
 type Wallets struct {
 	Wallets map[string]*Wallet
+	// RedeemScripts P2SH地址 => 赎回脚本, 花费多重签名地址的时候要用到
+	RedeemScripts map[string]Script
+	// ChangeOwners 找零地址 => 产生这个找零的发送地址, 余额和花费都算在发送地址上
+	ChangeOwners map[string]string
+	// Transactions 交易id(hex) => 钱包发出去还没有确认的交易, bumpfee的时候要用到
+	Transactions map[string]WalletTx
+}
+
+// WalletTx 钱包发出的交易
+type WalletTx struct {
+	Tx  Transaction
+	Fee int
+	// ChangeIndex 找零输出的索引, -1表示没有找零
+	ChangeIndex int
 }
 
 // NewWallets creates Wallets and fills it from a file if it exists
 func NewWallets(nodeID string) (*Wallets, error) {
 	wallets := Wallets{}
 	wallets.Wallets = make(map[string]*Wallet)
+	wallets.RedeemScripts = make(map[string]Script)
+	wallets.ChangeOwners = make(map[string]string)
+	wallets.Transactions = make(map[string]WalletTx)
 
 	err := wallets.LoadFromFile(nodeID)
 
@@ -46,14 +63,140 @@ func (ws *Wallets) GetAddresses() []string {
 	return addresses
 }
 
+// NewChangeAddress 为owner生成一个新的找零地址
+func (ws *Wallets) NewChangeAddress(owner string) string {
+	address := ws.CreateWallet()
+	ws.ChangeOwners[address] = ws.GetOwner(owner)
+
+	return address
+}
+
+// IsChange 判断address是否是找零地址
+func (ws Wallets) IsChange(address string) bool {
+	_, ok := ws.ChangeOwners[address]
+	return ok
+}
+
+// GetOwner 返回找零地址所属的发送地址, 不是找零地址时返回address本身
+func (ws Wallets) GetOwner(address string) string {
+	if owner, ok := ws.ChangeOwners[address]; ok {
+		return owner
+	}
+
+	return address
+}
+
+// GetChangeAddresses 返回owner所有的找零地址
+func (ws Wallets) GetChangeAddresses(owner string) []string {
+	var addresses []string
+
+	for address, changeOwner := range ws.ChangeOwners {
+		if changeOwner == owner {
+			addresses = append(addresses, address)
+		}
+	}
+	sort.Strings(addresses)
+
+	return addresses
+}
+
+// SignTransaction 用钱包里面的私钥对交易的所有输入签名, 输入可以属于不同的地址
+func (ws *Wallets) SignTransaction(tx *Transaction, bc *Blockchain) *Transaction {
+	ptx, err := NewPartiallySignedTx(tx, bc, ws.RedeemScripts)
+	if err != nil {
+		log.Panic(err)
+	}
+	ptx.Sign(ws)
+
+	signedTx, err := ptx.Finalize()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return signedTx
+}
+
 // GetWallet returns a Wallet by its address
 func (ws Wallets) GetWallet(address string) Wallet {
 	return *ws.Wallets[address]
 }
 
+// GetWalletByPubKey returns the Wallet owning pubKey, or nil if there is none
+func (ws Wallets) GetWalletByPubKey(pubKey []byte) *Wallet {
+	for _, wallet := range ws.Wallets {
+		if bytes.Compare(wallet.PublicKey, pubKey) == 0 {
+			return wallet
+		}
+	}
+
+	return nil
+}
+
+// AddRedeemScript remembers the redeem script of a P2SH address and returns the address
+func (ws *Wallets) AddRedeemScript(redeemScript Script) string {
+	address := fmt.Sprintf("%s", ScriptHashToAddress(HashPubKey(redeemScript)))
+	ws.RedeemScripts[address] = redeemScript
+
+	return address
+}
+
+// SignMultiSig 给花费P2SH多重签名输出的每个输入加上这些钱包能提供的签名, 返回新增的签名数量和还缺少的签名数量
+// 输入的解锁脚本是 <已经收集到的签名> <赎回脚本>, 交易在共同签名的钱包之间传递, 签名够了之后就是最终的解锁脚本
+func (ws Wallets) SignMultiSig(tx *Transaction) (int, int, error) {
+	added, missing := 0, 0
+
+	for inID, vin := range tx.Vin {
+		pushes, err := vin.ScriptSig.PushedData()
+		if err != nil || len(pushes) == 0 {
+			return 0, 0, fmt.Errorf("Input %d does not carry a redeem script", inID)
+		}
+		redeemScript := Script(pushes[len(pushes)-1])
+		m, pubKeys, ok := ExtractMultiSig(redeemScript)
+		if !ok {
+			return 0, 0, fmt.Errorf("Redeem script of input %d is not multisig", inID)
+		}
+
+		// 解锁脚本里面签名的顺序必须和赎回脚本里面公钥的顺序一致, 所以先找出已有的签名是哪个公钥的
+		hash := tx.SignatureHash(inID, redeemScript)
+		sigs := make([][]byte, len(pubKeys))
+		count := 0
+		for _, sig := range pushes[:len(pushes)-1] {
+			for i, pubKey := range pubKeys {
+				if sigs[i] == nil && verifySignature(hash, sig, pubKey) {
+					sigs[i] = sig
+					count++
+					break
+				}
+			}
+		}
+
+		for i, pubKey := range pubKeys {
+			wallet := ws.GetWalletByPubKey(pubKey)
+			if count >= m || sigs[i] != nil || wallet == nil {
+				continue
+			}
+
+			sigs[i] = tx.SignInput(wallet.PrivateKey, inID, redeemScript)
+			count++
+			added++
+		}
+
+		var collected [][]byte
+		for _, sig := range sigs {
+			if sig != nil && len(collected) < m {
+				collected = append(collected, sig)
+			}
+		}
+		tx.Vin[inID].ScriptSig = MultiSigSignatureScript(collected, redeemScript)
+		missing += m - len(collected)
+	}
+
+	return added, missing, nil
+}
+
 // LoadFromFile loads wallets from the file
 func (ws *Wallets) LoadFromFile(nodeID string) error {
-	walletFile := fmt.Sprintf(walletFile, nodeID)
+	walletFile := dataFile(walletFile, nodeID)
 	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
 		return err
 	}
@@ -64,25 +207,56 @@ func (ws *Wallets) LoadFromFile(nodeID string) error {
 	}
 
 	var wallets Wallets
-	gob.Register(elliptic.P256())
 	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
 	err = decoder.Decode(&wallets)
 	if err != nil {
-		log.Panic(err)
+		// 可能是旧格式的钱包文件, 下次保存的时候会换成新的格式
+		wallets, err = decodeLegacyWallets(fileContent)
+		if err != nil {
+			log.Panic(err)
+		}
 	}
 
 	ws.Wallets = wallets.Wallets
+	if wallets.RedeemScripts != nil {
+		ws.RedeemScripts = wallets.RedeemScripts
+	}
+	if wallets.ChangeOwners != nil {
+		ws.ChangeOwners = wallets.ChangeOwners
+	}
+	if wallets.Transactions != nil {
+		ws.Transactions = wallets.Transactions
+	}
+
+	// 没有补齐的公钥在解码时已经换成了补齐的, 地址也跟着变了
+	for address, wallet := range wallets.Wallets {
+		newAddress := fmt.Sprintf("%s", wallet.GetAddress())
+		if newAddress == address {
+			continue
+		}
+
+		log.Printf("Public key of %s was not padded, its address is now %s\n", address, newAddress)
+		delete(ws.Wallets, address)
+		ws.Wallets[newAddress] = wallet
+		for change, owner := range ws.ChangeOwners {
+			if owner == address {
+				ws.ChangeOwners[change] = newAddress
+			}
+		}
+		if owner, ok := ws.ChangeOwners[address]; ok {
+			delete(ws.ChangeOwners, address)
+			ws.ChangeOwners[newAddress] = owner
+		}
+	}
 
 	return nil
 }
 
 // SaveToFile saves wallets to a file
 func (ws Wallets) SaveToFile(nodeID string) {
-	walletFile := fmt.Sprintf(walletFile, nodeID)
+	walletFile := dataFile(walletFile, nodeID)
 	var content bytes.Buffer
 
-	gob.Register(elliptic.P256())
-
 	encoder := gob.NewEncoder(&content)
 	err := encoder.Encode(ws)
 	if err != nil {